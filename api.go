@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	apiAddr         = ""
+	apiSocket       = ""
+	apiToken        = ""
+	apiUser         = ""
+	apiPassword     = ""
+	apiTlsCert      = ""
+	apiTlsKey       = ""
+	apiTlsClientCa  = ""
+	apiAuthRequired = false
+)
+
+func init() {
+	if s := os.Getenv("VC_API_ADDR"); s != "" {
+		slog.Info(fmt.Sprintf("use api bind address from environment: %s", s))
+		apiAddr = s
+	}
+	if s := os.Getenv("VC_API_SOCKET"); s != "" {
+		slog.Info(fmt.Sprintf("use api unix socket from environment: %s", s))
+		apiSocket = s
+	}
+	apiToken = os.Getenv("VC_API_TOKEN")
+	apiUser, apiPassword = os.Getenv("VC_API_USER"), os.Getenv("VC_API_PASSWORD")
+	if (apiUser == "") != (apiPassword == "") {
+		slog.Warn("invalid environment value: VC_API_USER and VC_API_PASSWORD should be set together, basic auth disabled")
+		apiUser, apiPassword = "", ""
+	}
+	apiAuthRequired = apiToken != "" || apiUser != ""
+	if apiAuthRequired {
+		slog.Info("api authentication enabled")
+	}
+	apiTlsCert, apiTlsKey = os.Getenv("VC_API_TLS_CERT"), os.Getenv("VC_API_TLS_KEY")
+	if (apiTlsCert == "") != (apiTlsKey == "") {
+		slog.Warn("invalid environment value: VC_API_TLS_CERT and VC_API_TLS_KEY should be set together, tls disabled")
+		apiTlsCert, apiTlsKey = "", ""
+	}
+	apiTlsClientCa = os.Getenv("VC_API_TLS_CLIENT_CA")
+	if apiTlsClientCa != "" && apiTlsCert == "" {
+		slog.Warn("invalid environment value: VC_API_TLS_CLIENT_CA requires VC_API_TLS_CERT and VC_API_TLS_KEY, ignored")
+		apiTlsClientCa = ""
+	}
+}
+
+// withAuth lets a request through if it carries the bearer token or the
+// basic auth credentials, either one will do when both are configured. The
+// token is also accepted as the access_token query parameter, as browsers
+// cannot set headers on event streams. The static files of the dashboard are
+// served without authentication, the page asks for the token itself.
+func withAuth(next http.Handler) http.Handler {
+	if !apiAuthRequired {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dashboardFile(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if apiToken != "" {
+			if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") &&
+				secureEqual(strings.TrimPrefix(auth, "Bearer "), apiToken) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if token := r.URL.Query().Get("access_token"); token != "" && secureEqual(token, apiToken) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if apiUser != "" {
+			if user, password, ok := r.BasicAuth(); ok && secureEqual(user, apiUser) && secureEqual(password, apiPassword) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="vc"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vc"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func apiTlsConfig() (*tls.Config, error) {
+	if apiTlsCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(apiTlsCert, apiTlsKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading api certificate failed")
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if apiTlsClientCa != "" {
+		data, err := os.ReadFile(apiTlsClientCa)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading api client ca failed")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificate found in api client ca %s", apiTlsClientCa)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// serveApi serves the api on the tcp port, with tls if configured, and on
+// the unix socket, until ctx is done.
+func serveApi(ctx context.Context, handler http.Handler) {
+	tlsCfg, err := apiTlsConfig()
+	if err != nil {
+		slog.Error("configuring api tls failed", err)
+		return
+	}
+	var listeners []net.Listener
+	if apiPort > 0 {
+		l, err := net.Listen("tcp", net.JoinHostPort(apiAddr, fmt.Sprint(apiPort)))
+		if err != nil {
+			slog.Error("listening api port failed", err)
+			return
+		}
+		if tlsCfg != nil {
+			l = tls.NewListener(l, tlsCfg)
+		}
+		listeners = append(listeners, l)
+	}
+	if apiSocket != "" {
+		if err := os.Remove(apiSocket); err != nil && !os.IsNotExist(err) {
+			slog.Warn("removing stale api socket failed", slog.ErrorKey, err)
+		}
+		l, err := net.Listen("unix", apiSocket)
+		if err != nil {
+			slog.Error("listening api socket failed", err)
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return
+		}
+		if err := os.Chmod(apiSocket, 0660); err != nil {
+			slog.Warn("restricting api socket permission failed", slog.ErrorKey, err)
+		}
+		listeners = append(listeners, l)
+	}
+	server := http.Server{
+		Handler:     withAuth(handler),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+	wg := sync.WaitGroup{}
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			slog.Info(fmt.Sprintf("serving api on %s %s", l.Addr().Network(), l.Addr()))
+			if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("serving api failed", err)
+			}
+		}(l)
+	}
+	wg.Wait()
+}
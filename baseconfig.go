@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"vc/sub"
+	"vc/sub/check"
+	"vc/vc"
+)
+
+var baseHistorySize = 10
+
+func init() {
+	if s := os.Getenv("VC_BASE_CONFIG_HISTORY"); s != "" {
+		if i, err := strconv.Atoi(s); err != nil || i < 0 {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_BASE_CONFIG_HISTORY=%s", s))
+		} else {
+			baseHistorySize = i
+		}
+	}
+}
+
+// BaseVersion is a version of the base config, replaced at At.
+type BaseVersion struct {
+	Version int             `json:"version"`
+	At      time.Time       `json:"at"`
+	Config  json.RawMessage `json:"config"`
+}
+
+type baseHistory struct {
+	Current  int           `json:"current"`
+	Previous []BaseVersion `json:"previous"`
+}
+
+// the base config and its history are guarded by mux, like the serving config
+var (
+	baseCfg  *vc.Config
+	baseHist = baseHistory{Current: 1}
+)
+
+func baseHistoryFile() string {
+	return filepath.Join(stateDir, "base-history.json")
+}
+
+func loadBaseHistory(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "reading base config history failed")
+	}
+	saved := baseHistory{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return errors.Wrap(err, "decoding base config history failed")
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	baseHist = saved
+	return nil
+}
+
+// saveBaseHistory writes the history, mux should be held.
+func saveBaseHistory(filename string) error {
+	data, err := json.Marshal(baseHist)
+	if err != nil {
+		return errors.Wrap(err, "encoding base config history failed")
+	}
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "writing base config history failed")
+	}
+	return errors.Wrap(os.Rename(tmp, filename), "replacing base config history failed")
+}
+
+// validateConfig checks what the core would reject or the controller cannot
+// work with.
+func validateConfig(cfg *vc.Config) error {
+	if len(cfg.Inbounds) == 0 {
+		return errors.Errorf("no inbounds")
+	}
+	if len(cfg.Outbounds) == 0 {
+		return errors.Errorf("no outbounds")
+	}
+	if subUrl != "" && (cfg.Routing == nil || len(cfg.Routing.Balancers) == 0) {
+		return errors.Errorf("a balancer is required for the subscription endpoints")
+	}
+	inbounds, outbounds, balancers := map[string]bool{}, map[string]bool{coreApiTag: true}, map[string]bool{}
+	// an empty tag counts as a tag, only one inbound or outbound may go
+	// without one
+	for _, inbound := range cfg.Inbounds {
+		if inbounds[inbound.Tag] {
+			return errors.Errorf("duplicated inbound tag %q", inbound.Tag)
+		}
+		inbounds[inbound.Tag] = true
+	}
+	for _, outbound := range cfg.Outbounds {
+		if outbounds[outbound.Tag] {
+			return errors.Errorf("duplicated outbound tag %q", outbound.Tag)
+		}
+		outbounds[outbound.Tag] = true
+	}
+	if subUrl != "" && enableCheck {
+		if err := check.ValidateFallback(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Routing == nil {
+		return nil
+	}
+	for _, b := range cfg.Routing.Balancers {
+		if balancers[b.Tag] {
+			return errors.Errorf("duplicated balancer tag %q", b.Tag)
+		}
+		balancers[b.Tag] = true
+	}
+	for i, rule := range cfg.Routing.Rules {
+		if rule.OutboundTag == "" && rule.BalancerTag == "" {
+			return errors.Errorf("rule %d has neither outboundTag nor balancerTag", i)
+		}
+		if rule.OutboundTag != "" && !outbounds[rule.OutboundTag] {
+			return errors.Errorf("rule %d routes to unknown outbound %q", i, rule.OutboundTag)
+		}
+		if rule.BalancerTag != "" && !balancers[rule.BalancerTag] {
+			return errors.Errorf("rule %d routes to unknown balancer %q", i, rule.BalancerTag)
+		}
+	}
+	return nil
+}
+
+// validateSelectors checks that the selector of every balancer matches some
+// outbound by prefix, as the core matches them.
+func validateSelectors(cfg *vc.Config) error {
+	if cfg.Routing == nil {
+		return nil
+	}
+	for _, b := range cfg.Routing.Balancers {
+		if len(b.Selector) == 0 {
+			return errors.Errorf("balancer %q has no selector", b.Tag)
+		}
+		for _, selector := range b.Selector {
+			found := false
+			for _, outbound := range cfg.Outbounds {
+				if strings.HasPrefix(outbound.Tag, selector) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.Errorf("selector %q of balancer %q matches no outbound", selector, b.Tag)
+			}
+		}
+	}
+	return nil
+}
+
+// rebase builds the serving config on a new base config, with the current
+// endpoints and balance, and checks it can be rendered for the core. mux
+// should be held.
+func rebase(base *vc.Config) (*vc.Config, error) {
+	if err := validateConfig(base); err != nil {
+		return nil, err
+	}
+	cfg := base
+	var err error
+	if len(lastSubEps) > 0 {
+		if cfg, err = sub.Override(base, lastSubEps); err != nil {
+			return nil, err
+		}
+		if eps := balancedEps(); len(eps) > 0 && (check.HasOverrides() || enableCheck) {
+			if cfg, err = check.Balance(cfg, eps); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, errors.WithMessage(err, "config with subscription endpoints")
+	}
+	// the selectors of the base config are only placeholders until the
+	// endpoints of the subscription fill them
+	if subUrl == "" || len(lastSubEps) > 0 {
+		if err := validateSelectors(cfg); err != nil {
+			return nil, err
+		}
+	}
+	materialized, err := materialize(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := coreDriver.Render(materialized); err != nil {
+		return nil, errors.Wrapf(err, "rendering config for %s failed", coreDriver.Name())
+	}
+	if blueGreen {
+		if _, _, err := shiftConfig(materialized, 0); err != nil {
+			return nil, errors.WithMessage(err, "config cannot run in blue/green mode")
+		}
+	}
+	return cfg, nil
+}
+
+// replaceBase makes base the base config, keeping the previous one in the
+// history. mux should be held.
+func replaceBase(filename string, base *vc.Config) (bool, error) {
+	cfg, err := rebase(base)
+	if err != nil {
+		return false, err
+	}
+	previous, err := json.Marshal(baseCfg)
+	if err != nil {
+		return false, errors.Wrap(err, "marshalling previous base config failed")
+	}
+	if err := saveBaseState(base); err != nil {
+		return false, err
+	}
+	changed := !jsonEqual(cfg, servingCfg)
+	if changed {
+		if err := writeConfig(filename, cfg); err != nil {
+			return false, err
+		}
+		publishBalancers(servingCfg, cfg)
+		servingCfg = cfg
+	}
+	baseCfg = base
+	if baseHistorySize > 0 {
+		baseHist.Previous = append(baseHist.Previous, BaseVersion{Version: baseHist.Current, At: time.Now(), Config: previous})
+		if len(baseHist.Previous) > baseHistorySize {
+			baseHist.Previous = baseHist.Previous[len(baseHist.Previous)-baseHistorySize:]
+		}
+	}
+	baseHist.Current++
+	if err := saveBaseHistory(baseHistoryFile()); err != nil {
+		slog.Warn("saving base config history failed", slog.ErrorKey, err)
+	}
+	return changed, nil
+}
+
+// BaseResult is the outcome of a base config change.
+type BaseResult struct {
+	Version   int    `json:"version"`
+	Changed   bool   `json:"changed"`
+	Restarted bool   `json:"restarted"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleBaseConfig serves the base config on GET, replaces it on PUT, and
+// merges a json merge patch (RFC 7396) into it on PATCH. The version is the
+// ETag, checked against If-Match when present.
+func handleBaseConfig(ctx context.Context, filename string, restartNotify chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mux.Lock()
+			data, err := json.MarshalIndent(baseCfg, "", "  ")
+			version := baseHist.Current
+			mux.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("ETag", strconv.Quote(strconv.Itoa(version)))
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(data)
+			return
+		}
+		if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+			w.Header().Set("Allow", "GET, PUT, PATCH")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		applyBase(ctx, filename, restartNotify, w, r.Header.Get("If-Match"), func(current *vc.Config) (*vc.Config, error) {
+			if r.Method == http.MethodPatch {
+				return patchConfig(current, body)
+			}
+			return decodeConfig(body)
+		})
+	}
+}
+
+// handleBaseRollback makes the version in the path the base config again.
+func handleBaseRollback(ctx context.Context, filename string, restartNotify chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/base-config/rollback/"))
+		if err != nil {
+			http.Error(w, "invalid version", http.StatusBadRequest)
+			return
+		}
+		applyBase(ctx, filename, restartNotify, w, "", func(*vc.Config) (*vc.Config, error) {
+			for _, v := range baseHist.Previous {
+				if v.Version == version {
+					return decodeConfig(v.Config)
+				}
+			}
+			return nil, errNotFound
+		})
+	}
+}
+
+func handleBaseHistory(w http.ResponseWriter, _ *http.Request) {
+	mux.Lock()
+	hist := baseHistory{Current: baseHist.Current, Previous: append([]BaseVersion(nil), baseHist.Previous...)}
+	mux.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(hist)
+}
+
+var (
+	errNotFound = errors.New("version not found")
+	errConflict = errors.New("base config was changed by someone else")
+)
+
+// applyBase replaces the base config by what update makes of the current one,
+// and brings the core up to date.
+func applyBase(ctx context.Context, filename string, restartNotify chan<- struct{}, w http.ResponseWriter,
+	ifMatch string, update func(current *vc.Config) (*vc.Config, error)) {
+	result, status := BaseResult{}, http.StatusOK
+	mux.Lock()
+	base, err := func() (*vc.Config, error) {
+		if ifMatch != "" && ifMatch != strconv.Quote(strconv.Itoa(baseHist.Current)) {
+			return nil, errConflict
+		}
+		current, err := vc.DeepClone(baseCfg)
+		if err != nil {
+			return nil, err
+		}
+		return update(current)
+	}()
+	if err == nil {
+		result.Changed, err = replaceBase(filename, base)
+	}
+	result.Version = baseHist.Current
+	mux.Unlock()
+	switch {
+	case errors.Is(err, errNotFound):
+		status, result.Error = http.StatusNotFound, err.Error()
+	case errors.Is(err, errConflict):
+		status, result.Error = http.StatusPreconditionFailed, err.Error()
+	case err != nil:
+		status, result.Error = http.StatusUnprocessableEntity, err.Error()
+	default:
+		slog.Info(fmt.Sprintf("An API request recieved, base config replaced by version %d", result.Version))
+		if result.Changed {
+			result.Restarted = applyChange(ctx, filename, restartNotify)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// decodeConfig rejects the fields the config model does not know, rather
+// than silently dropping them from the base config.
+func decodeConfig(data []byte) (*vc.Config, error) {
+	cfg := &vc.Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, errors.Wrap(err, "decoding config failed")
+	}
+	return cfg, nil
+}
+
+func patchConfig(cfg *vc.Config, patch []byte) (*vc.Config, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling config failed")
+	}
+	var target, p any
+	if err := json.Unmarshal(data, &target); err != nil {
+		return nil, errors.Wrap(err, "decoding config failed")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(patch))
+	decoder.UseNumber()
+	if err := decoder.Decode(&p); err != nil {
+		return nil, errors.Wrap(err, "decoding patch failed")
+	}
+	data, err = json.Marshal(mergePatch(target, p))
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling patched config failed")
+	}
+	return decodeConfig(data)
+}
+
+// mergePatch applies a json merge patch: objects are merged recursively, null
+// removes a member, anything else replaces the target.
+func mergePatch(target any, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = mergePatch(t[key], value)
+	}
+	return t
+}
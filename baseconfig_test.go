@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"vc/vc"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+		want   string
+	}{
+		{name: "replace", target: `{"a": "b"}`, patch: `{"a": "c"}`, want: `{"a": "c"}`},
+		{name: "add", target: `{"a": "b"}`, patch: `{"b": "c"}`, want: `{"a": "b", "b": "c"}`},
+		{name: "remove", target: `{"a": "b", "b": "c"}`, patch: `{"a": null}`, want: `{"b": "c"}`},
+		{name: "nested", target: `{"a": {"b": "c", "d": "e"}}`, patch: `{"a": {"b": "x", "d": null}}`, want: `{"a": {"b": "x"}}`},
+		{name: "array replaced", target: `{"a": [1, 2]}`, patch: `{"a": [3]}`, want: `{"a": [3]}`},
+		{name: "object over scalar", target: `{"a": "b"}`, patch: `{"a": {"c": "d"}}`, want: `{"a": {"c": "d"}}`},
+		{name: "null in new object", target: `{}`, patch: `{"a": {"b": null}}`, want: `{"a": {}}`},
+		{name: "not an object", target: `{"a": "b"}`, patch: `["c"]`, want: `["c"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var target, patch, want any
+			for _, v := range []struct {
+				data string
+				to   *any
+			}{{tt.target, &target}, {tt.patch, &patch}, {tt.want, &want}} {
+				if err := json.Unmarshal([]byte(v.data), v.to); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+				t.Errorf("mergePatch() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPatchConfig(t *testing.T) {
+	cfg := &vc.Config{
+		Inbounds:  []*vc.Inbound{{Tag: "socks", Port: 1080, Protocol: "socks"}},
+		Outbounds: []*vc.Outbound{{Tag: "direct", Protocol: "freedom"}},
+	}
+	patched, err := patchConfig(cfg, []byte(`{"log": {"loglevel": "debug"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Log == nil || patched.Log.LogLevel != "debug" || len(patched.Inbounds) != 1 {
+		t.Errorf("patchConfig() = %+v, want the log level set and the inbound kept", patched)
+	}
+	if _, err := patchConfig(cfg, []byte(`{"unknown": true}`)); err == nil {
+		t.Errorf("patchConfig() with an unknown field succeeded")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	savedUrl, savedCheck := subUrl, enableCheck
+	t.Cleanup(func() {
+		subUrl, enableCheck = savedUrl, savedCheck
+	})
+	subUrl, enableCheck = "https://example.com/sub", false
+	tests := []struct {
+		name    string
+		cfg     string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			cfg: `{"inbounds": [{"tag": "socks", "port": 1080, "protocol": "socks"}],
+				"outbounds": [{"tag": "direct", "protocol": "freedom"}, {"tag": "block", "protocol": "blackhole"}],
+				"routing": {"balancers": [{"tag": "main", "selector": ["proxy"]}],
+					"rules": [{"type": "field", "ip": ["geoip:private"], "outboundTag": "block"},
+						{"type": "field", "network": "tcp,udp", "balancerTag": "main"},
+						{"type": "field", "inboundTag": ["` + coreApiTag + `"], "outboundTag": "` + coreApiTag + `"}]}}`,
+		},
+		{
+			name:    "no inbounds",
+			cfg:     `{"outbounds": [{"tag": "direct", "protocol": "freedom"}]}`,
+			wantErr: "no inbounds",
+		},
+		{
+			name:    "no outbounds",
+			cfg:     `{"inbounds": [{"tag": "socks", "port": 1080}]}`,
+			wantErr: "no outbounds",
+		},
+		{
+			name:    "no balancer",
+			cfg:     `{"inbounds": [{"tag": "socks", "port": 1080}], "outbounds": [{"tag": "direct"}]}`,
+			wantErr: "a balancer is required",
+		},
+		{
+			name: "repeated empty inbound tags",
+			cfg: `{"inbounds": [{"port": 1080}, {"port": 1081}], "outbounds": [{"tag": "direct"}],
+				"routing": {"balancers": [{"tag": "main"}]}}`,
+			wantErr: `duplicated inbound tag ""`,
+		},
+		{
+			name: "duplicated outbound tag",
+			cfg: `{"inbounds": [{"port": 1080}], "outbounds": [{"tag": "direct"}, {"tag": "direct"}],
+				"routing": {"balancers": [{"tag": "main"}]}}`,
+			wantErr: `duplicated outbound tag "direct"`,
+		},
+		{
+			name: "duplicated balancer tag",
+			cfg: `{"inbounds": [{"port": 1080}], "outbounds": [{"tag": "direct"}],
+				"routing": {"balancers": [{"tag": "main"}, {"tag": "main"}]}}`,
+			wantErr: `duplicated balancer tag "main"`,
+		},
+		{
+			name: "rule to nowhere",
+			cfg: `{"inbounds": [{"port": 1080}], "outbounds": [{"tag": "direct"}],
+				"routing": {"balancers": [{"tag": "main"}], "rules": [{"type": "field", "port": 53}]}}`,
+			wantErr: "neither outboundTag nor balancerTag",
+		},
+		{
+			name: "unknown outbound",
+			cfg: `{"inbounds": [{"port": 1080}], "outbounds": [{"tag": "direct"}],
+				"routing": {"balancers": [{"tag": "main"}], "rules": [{"type": "field", "outboundTag": "proxy"}]}}`,
+			wantErr: `unknown outbound "proxy"`,
+		},
+		{
+			name: "unknown balancer",
+			cfg: `{"inbounds": [{"port": 1080}], "outbounds": [{"tag": "direct"}],
+				"routing": {"balancers": [{"tag": "main"}], "rules": [{"type": "field", "balancerTag": "other"}]}}`,
+			wantErr: `unknown balancer "other"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := decodeConfig([]byte(tt.cfg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = validateConfig(cfg)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateConfig() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSelectors(t *testing.T) {
+	cfg := &vc.Config{
+		Outbounds: []*vc.Outbound{{Tag: "proxy-a"}, {Tag: "direct"}},
+		Routing:   &vc.Routing{Balancers: []*vc.Balancer{{Tag: "main", Selector: []string{"proxy-"}}}},
+	}
+	if err := validateSelectors(cfg); err != nil {
+		t.Errorf("validateSelectors() = %v", err)
+	}
+	cfg.Routing.Balancers[0].Selector = []string{"proxy-", "other"}
+	if err := validateSelectors(cfg); err == nil {
+		t.Errorf("validateSelectors() with an unmatched selector succeeded")
+	}
+	cfg.Routing.Balancers[0].Selector = nil
+	if err := validateSelectors(cfg); err == nil {
+		t.Errorf("validateSelectors() without a selector succeeded")
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vc/sub/check"
+	"vc/vc"
+)
+
+var (
+	blueGreen        = false
+	blueGreenOffsets = [2]int{10000, 20000}
+	// blueGreenInternal are where the internal ports of either instance start
+	blueGreenInternal = [2]int{30000, 40000}
+	blueGreenReady    = time.Second * 30
+	blueGreenDrain    = time.Second * 30
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_BLUE_GREEN"); ok && (s == "true" || s == "on") {
+		slog.Info("blue/green core swap enabled")
+		blueGreen = true
+	}
+	if s := os.Getenv("VC_BLUE_GREEN_OFFSETS"); s != "" {
+		if pair, ok := parsePair(s); !ok {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_BLUE_GREEN_OFFSETS=%s", s))
+		} else {
+			blueGreenOffsets = pair
+		}
+	}
+	if s := os.Getenv("VC_BLUE_GREEN_INTERNAL_PORTS"); s != "" {
+		if pair, ok := parsePair(s); !ok || pair[0] > 65535 || pair[1] > 65535 {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_BLUE_GREEN_INTERNAL_PORTS=%s", s))
+		} else {
+			blueGreenInternal = pair
+		}
+	}
+	if s := os.Getenv("VC_BLUE_GREEN_READY_TIMEOUT"); s != "" {
+		if sec, err := strconv.ParseInt(s, 10, 64); err != nil {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_BLUE_GREEN_READY_TIMEOUT=%s", s))
+		} else {
+			blueGreenReady = time.Second * time.Duration(sec)
+		}
+	}
+	if s := os.Getenv("VC_BLUE_GREEN_DRAIN"); s != "" {
+		if sec, err := strconv.ParseInt(s, 10, 64); err != nil {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_BLUE_GREEN_DRAIN=%s", s))
+		} else {
+			blueGreenDrain = time.Second * time.Duration(sec)
+		}
+	}
+}
+
+// parsePair parses two different positive integers separated by a comma.
+func parsePair(s string) ([2]int, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return [2]int{}, false
+	}
+	a, errA := strconv.Atoi(strings.TrimSpace(parts[0]))
+	b, errB := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if errA != nil || errB != nil || a <= 0 || b <= 0 || a == b {
+		return [2]int{}, false
+	}
+	return [2]int{a, b}, true
+}
+
+// inboundPort returns the single tcp port an inbound listens on, if any.
+func inboundPort(inbound *vc.Inbound) (int, bool) {
+	switch p := inbound.Port.(type) {
+	case float64:
+		return int(p), true
+	case int:
+		return p, true
+	case json.Number:
+		i, err := strconv.Atoi(string(p))
+		return i, err == nil
+	case string:
+		i, err := strconv.Atoi(p)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// isInternal reports whether an inbound is only used by vc itself, like the
+// test inbounds of the checker and the API inbound.
+func isInternal(inbound *vc.Inbound) bool {
+	return inbound.Tag == coreApiTag || strings.HasPrefix(inbound.Tag, "test-in-")
+}
+
+// instancePorts returns the port every inbound listens on in the instance of
+// slot. Public inbounds are shifted by the offset of the slot, while internal
+// inbounds take the next ports of the internal range of the slot, since the
+// test ports are many and would run into the shifted public ones.
+func instancePorts(cfg *vc.Config, slot int) ([]int, error) {
+	ports := make([]int, len(cfg.Inbounds))
+	internal := blueGreenInternal[slot]
+	for i, inbound := range cfg.Inbounds {
+		port, ok := inboundPort(inbound)
+		if !ok {
+			return nil, errors.Errorf("inbound %q has no single port, cannot be forwarded", inbound.Tag)
+		}
+		if isInternal(inbound) {
+			port = internal
+			internal++
+		} else {
+			if s := inbound.Settings; s != nil && (s.Udp || strings.Contains(s.Network, "udp")) {
+				return nil, errors.Errorf("inbound %q accepts udp, which cannot be forwarded in blue/green mode", inbound.Tag)
+			}
+			port += blueGreenOffsets[slot]
+		}
+		if port > 65535 {
+			return nil, errors.Errorf("port %d of inbound %q in core instance %d is out of range", port, inbound.Tag, slot)
+		}
+		ports[i] = port
+	}
+	return ports, nil
+}
+
+// shiftConfig moves every inbound to loopback, on its port in the instance of
+// slot, and returns the addresses to forward with the ports they go to. It
+// fails if any port would be taken twice, by the forwarder, either instance,
+// or the API of vc.
+func shiftConfig(cfg *vc.Config, slot int) (*vc.Config, map[string]int, error) {
+	cfg, err := vc.DeepClone(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	ports, err := instancePorts(cfg, slot)
+	if err != nil {
+		return nil, nil, err
+	}
+	others, err := instancePorts(cfg, 1-slot)
+	if err != nil {
+		return nil, nil, err
+	}
+	owners := map[int]string{}
+	if apiPort > 0 {
+		owners[apiPort] = "the api"
+	}
+	take := func(port int, owner string) error {
+		if other, found := owners[port]; found {
+			return errors.Errorf("port %d of %s is taken by %s", port, owner, other)
+		}
+		owners[port] = owner
+		return nil
+	}
+	forwards := make(map[string]int, len(cfg.Inbounds))
+	for i, inbound := range cfg.Inbounds {
+		port, _ := inboundPort(inbound)
+		if err := take(port, fmt.Sprintf("inbound %q", inbound.Tag)); err != nil {
+			return nil, nil, err
+		}
+		for j, p := range [2]int{ports[i], others[i]} {
+			if err := take(p, fmt.Sprintf("inbound %q in core instance %d", inbound.Tag, slot^j)); err != nil {
+				return nil, nil, err
+			}
+		}
+		forwards[net.JoinHostPort(inbound.Listen, strconv.Itoa(port))] = ports[i]
+		inbound.Listen = "127.0.0.1"
+		inbound.Port = ports[i]
+	}
+	return cfg, forwards, nil
+}
+
+// startInstance runs the core in slot with the config file shifted for it,
+// waits until it is ready, and probes it through a test inbound.
+func startInstance(ctx context.Context, filename string, slot int) (*instance, map[string]int, error) {
+	cfg, err := loadConfigFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset := blueGreenOffsets[slot]
+	shifted, forwards, err := shiftConfig(cfg, slot)
+	if err != nil {
+		// retrying does not help until the config changes
+		return nil, nil, fatalError(err.Error())
+	}
+	data, err := json.Marshal(shifted)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "marshalling shifted config failed")
+	}
+	shiftedFile := filepath.Join(filepath.Dir(filename), fmt.Sprintf("config-%d.json", offset))
+	if err := os.WriteFile(shiftedFile, data, 0644); err != nil {
+		return nil, nil, errors.Wrap(err, "writing shifted config failed")
+	}
+	i, err := launch(shiftedFile, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := waitInbounds(ctx, shifted, i.exited, blueGreenReady); err != nil {
+		select {
+		case <-i.exited:
+			if exitErr := i.exitErr(); exitErr != nil {
+				err = errors.WithMessage(exitErr, err.Error())
+			}
+		default:
+			i.stop()
+		}
+		return nil, nil, err
+	}
+	if port, ok := selfCheckPort(shifted); ok {
+		if err := check.ProbeInbound(ctx, port); err != nil {
+			i.stop()
+			return nil, nil, errors.WithMessage(err, "self-check of the new core failed")
+		}
+	}
+	return i, forwards, nil
+}
+
+// selfCheckPort returns the port of a test inbound to probe a core instance
+// through, if any.
+func selfCheckPort(cfg *vc.Config) (int, bool) {
+	for _, inbound := range cfg.Inbounds {
+		if strings.HasPrefix(inbound.Tag, "test-in-") && inbound.Protocol == "socks" {
+			return inboundPort(inbound)
+		}
+	}
+	return 0, false
+}
+
+// draining is an old core instance stopped once its connections are done.
+type draining struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func runBlueGreenLoop(ctx context.Context, filename string, restart chan struct{}) {
+	fwd := newForwarder()
+	var (
+		active  *instance
+		next    = 0
+		crashes = 0
+		retry   <-chan time.Time
+		// old instances still draining, by slot
+		drains [2]*draining
+	)
+	// stopDrain cuts the drain of the old instance in slot short, and waits
+	// until it is stopped.
+	stopDrain := func(slot int) {
+		if d := drains[slot]; d != nil {
+			d.cancel()
+			<-d.done
+			drains[slot] = nil
+		}
+	}
+	swap := func() error {
+		slot, offset := next, blueGreenOffsets[next]
+		// the ports of the slot must be free for the new instance
+		stopDrain(slot)
+		slog.Info(fmt.Sprintf("starting core on offset %d...", offset))
+		i, forwards, err := startInstance(ctx, filename, slot)
+		if err != nil {
+			slog.Error("starting new core failed, keep the current one", err)
+			return err
+		}
+		if err := fwd.update(forwards, offset); err != nil {
+			i.stop()
+			slog.Error("forwarding to new core failed, keep the current one", err)
+			return err
+		}
+		coreStarted(filename)
+		supervisor.started(i.cmd.Process.Pid)
+		supervisor.markReady(i.cmd.Process.Pid, nil)
+		slog.Info(fmt.Sprintf("traffic switched to core on offset %d", offset))
+		next = 1 - slot
+		if old := active; old != nil {
+			drainCtx, cancel := context.WithCancel(ctx)
+			d := &draining{cancel: cancel, done: make(chan struct{})}
+			drains[1-slot] = d
+			go func() {
+				defer close(d.done)
+				defer cancel()
+				fwd.drain(drainCtx, old.offset, blueGreenDrain)
+				slog.Info(fmt.Sprintf("stop core on offset %d...", old.offset))
+				old.stop()
+			}()
+		}
+		active = i
+		return nil
+	}
+	failed := func(err error) {
+		supervisor.exited(err)
+		crashes++
+		var fatal fatalError
+		if errors.As(err, &fatal) || coreMaxRestarts > 0 && crashes > coreMaxRestarts {
+			if fatal != "" {
+				slog.Error("core cannot start with the config, give up until restart is requested", err)
+			} else {
+				slog.Error(fmt.Sprintf("core failed %d times in a row, give up until restart is requested", crashes), err)
+			}
+			supervisor.set(CoreFailed, crashes, nil)
+			retry = nil
+			return
+		}
+		state, delay := CoreBackoff, backoff(crashes)
+		if crashes >= coreCrashLoop {
+			state = CoreCrashLoop
+		}
+		next := time.Now().Add(delay)
+		supervisor.set(state, crashes, &next)
+		slog.Info(fmt.Sprintf("start core again in %s", delay))
+		retry = time.After(delay)
+	}
+	if err := swap(); err != nil {
+		failed(err)
+	}
+	for {
+		var exited chan struct{}
+		if active != nil {
+			exited = active.exited
+		}
+		select {
+		case <-ctx.Done():
+			supervisor.setReady(false)
+			fwd.close()
+			stopDrain(0)
+			stopDrain(1)
+			if active != nil {
+				active.stop()
+				supervisor.exited(nil)
+			}
+			supervisor.set(CoreStopped, 0, nil)
+			return
+		case <-restart:
+			if err := swap(); err == nil {
+				crashes, retry = 0, nil
+				supervisor.set(CoreRunning, 0, nil)
+			} else if active == nil {
+				failed(err)
+			}
+		case <-exited:
+			slog.Warn("active core exited, starting a new one")
+			supervisor.setReady(false)
+			supervisor.exited(active.exitErr())
+			if time.Since(active.startedAt) > coreStableAfter {
+				crashes = 0
+			}
+			active = nil
+			if err := swap(); err != nil {
+				failed(err)
+			}
+		case <-retry:
+			retry = nil
+			if err := swap(); err == nil {
+				supervisor.set(CoreRunning, crashes, nil)
+			} else {
+				failed(err)
+			}
+		}
+	}
+}
+
+// forwarder accepts connections on the inbound addresses and relays them to
+// the active core instance.
+type forwarder struct {
+	mux       sync.Mutex
+	route     atomic.Pointer[route]
+	listeners map[string]net.Listener
+	conns     map[int]*atomic.Int64
+}
+
+// route is where the active core instance, known by its offset, listens for
+// every forwarded address.
+type route struct {
+	offset int
+	ports  map[string]int
+}
+
+func newForwarder() *forwarder {
+	return &forwarder{
+		listeners: map[string]net.Listener{},
+		conns:     map[int]*atomic.Int64{},
+	}
+}
+
+// update routes the forwarded addresses to the core instance on offset. If
+// any new address cannot be listened on, nothing is changed.
+func (f *forwarder) update(forwards map[string]int, offset int) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	opened := map[string]net.Listener{}
+	for addr := range forwards {
+		if _, found := f.listeners[addr]; found {
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range opened {
+				_ = l.Close()
+			}
+			return errors.Wrapf(err, "listening on %s failed", addr)
+		}
+		opened[addr] = l
+	}
+	f.route.Store(&route{offset: offset, ports: forwards})
+	for addr, l := range f.listeners {
+		if _, found := forwards[addr]; !found {
+			_ = l.Close()
+			delete(f.listeners, addr)
+		}
+	}
+	for addr, l := range opened {
+		f.listeners[addr] = l
+		go f.serve(l, addr)
+	}
+	return nil
+}
+
+func (f *forwarder) counter(offset int) *atomic.Int64 {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	c, found := f.conns[offset]
+	if !found {
+		c = &atomic.Int64{}
+		f.conns[offset] = c
+	}
+	return c
+}
+
+func (f *forwarder) serve(l net.Listener, addr string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go f.relay(conn, addr)
+	}
+}
+
+func (f *forwarder) relay(conn net.Conn, addr string) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	r := f.route.Load()
+	port, found := r.ports[addr]
+	if !found {
+		return
+	}
+	upstream, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		slog.Warn(fmt.Sprintf("forwarding %s to port %d failed", addr, port), slog.ErrorKey, err)
+		return
+	}
+	defer func() {
+		_ = upstream.Close()
+	}()
+	c := f.counter(r.offset)
+	c.Add(1)
+	defer c.Add(-1)
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	<-done
+}
+
+// drain waits for the connections to the core on offset to finish, at most
+// timeout or until ctx is done.
+func (f *forwarder) drain(ctx context.Context, offset int, timeout time.Duration) {
+	c := f.counter(offset)
+	deadline := time.Now().Add(timeout)
+	for c.Load() > 0 && time.Now().Before(deadline) && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-time.After(readyInterval):
+		}
+	}
+	if n := c.Load(); n > 0 {
+		slog.Info(fmt.Sprintf("%d connections to core on offset %d are still open, stop it anyway", n, offset))
+	}
+}
+
+func (f *forwarder) close() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for addr, l := range f.listeners {
+		_ = l.Close()
+		delete(f.listeners, addr)
+	}
+}
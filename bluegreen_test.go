@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"vc/vc"
+)
+
+func TestShiftConfig(t *testing.T) {
+	offsets, internal, port := blueGreenOffsets, blueGreenInternal, apiPort
+	t.Cleanup(func() {
+		blueGreenOffsets, blueGreenInternal, apiPort = offsets, internal, port
+	})
+	blueGreenOffsets, blueGreenInternal, apiPort = [2]int{10000, 20000}, [2]int{30000, 40000}, 11081
+	cfg := &vc.Config{
+		Inbounds: []*vc.Inbound{
+			{Tag: "socks", Listen: "0.0.0.0", Port: 1080, Protocol: "socks"},
+			{Tag: "http", Port: "8080", Protocol: "http"},
+			{Tag: "test-in-a", Listen: "127.0.0.1", Port: 20001, Protocol: "socks"},
+			{Tag: coreApiTag, Listen: "127.0.0.1", Port: 10085, Protocol: "dokodemo-door"},
+		},
+	}
+	shifted, forwards, err := shiftConfig(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPorts := []int{21080, 28080, 40000, 40001}
+	for i, inbound := range shifted.Inbounds {
+		if inbound.Listen != "127.0.0.1" || inbound.Port != wantPorts[i] {
+			t.Errorf("inbound %s listens on %s:%v, want 127.0.0.1:%d", inbound.Tag, inbound.Listen, inbound.Port, wantPorts[i])
+		}
+	}
+	wantForwards := map[string]int{
+		"0.0.0.0:1080":    21080,
+		":8080":           28080,
+		"127.0.0.1:20001": 40000,
+		"127.0.0.1:10085": 40001,
+	}
+	if len(forwards) != len(wantForwards) {
+		t.Errorf("forwards = %v, want %v", forwards, wantForwards)
+	}
+	for addr, port := range wantForwards {
+		if forwards[addr] != port {
+			t.Errorf("%s is forwarded to %d, want %d", addr, forwards[addr], port)
+		}
+	}
+	if cfg.Inbounds[0].Port != 1080 {
+		t.Errorf("shiftConfig() changed the original config")
+	}
+	if port, ok := selfCheckPort(shifted); !ok || port != 40000 {
+		t.Errorf("selfCheckPort() = %d, %v, want 40000, true", port, ok)
+	}
+
+	tests := []struct {
+		name     string
+		inbounds []*vc.Inbound
+	}{
+		{
+			name:     "udp",
+			inbounds: []*vc.Inbound{{Tag: "dns", Port: 53, Protocol: "dokodemo-door", Settings: &vc.InboundCommonSettings{Network: "tcp,udp"}}},
+		},
+		{
+			name:     "socks with udp",
+			inbounds: []*vc.Inbound{{Tag: "socks", Port: 1080, Protocol: "socks", Settings: &vc.InboundCommonSettings{Udp: true}}},
+		},
+		{
+			name:     "port range",
+			inbounds: []*vc.Inbound{{Tag: "range", Port: "1000-2000", Protocol: "socks"}},
+		},
+		{
+			name:     "out of range",
+			inbounds: []*vc.Inbound{{Tag: "high", Port: 50000, Protocol: "socks"}},
+		},
+		{
+			name:     "shifted onto another inbound",
+			inbounds: []*vc.Inbound{{Tag: "a", Port: 1080}, {Tag: "b", Port: 11080}},
+		},
+		{
+			name:     "shifted onto the api",
+			inbounds: []*vc.Inbound{{Tag: "a", Port: 1081}},
+		},
+		{
+			name:     "taking the api port",
+			inbounds: []*vc.Inbound{{Tag: "a", Port: 11081}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := shiftConfig(&vc.Config{Inbounds: tt.inbounds}, 0); err == nil {
+				t.Errorf("shiftConfig() succeeded")
+			}
+		})
+	}
+}
@@ -1,14 +1,32 @@
 #!/usr/bin/env bash
+if [ -z "${CORE}" ]; then
+  CORE=v2ray4
+fi
 if [ -z "${RELEASE}" ]; then
-  RELEASE=v4.45.2
+  case ${CORE} in
+    "xray")
+      RELEASE=v1.8.4
+      ;;
+    "v2ray5")
+      RELEASE=v5.7.0
+      ;;
+    "sing-box")
+      RELEASE=v1.3.0
+      ;;
+    *)
+      RELEASE=v4.45.2
+      ;;
+  esac
 fi
 ARCH=$(uname -i)
 case ${ARCH} in
   "aarch64" | "arm64")
     ARCH="arm64-v8a"
+    SB_ARCH="arm64"
     ;;
   "x86_64")
     ARCH="64"
+    SB_ARCH="amd64"
     ;;
   *)
     echo "only amd64/x86_64 and arm64/aarch64 platform are supported."
@@ -17,11 +35,30 @@ case ${ARCH} in
 esac
 SAVE_DIR=$(mktemp -d)
 echo "SAVE_DIR: ${SAVE_DIR}"
-curl -L -o ${SAVE_DIR}/v2ray.zip https://github.com/v2fly/v2ray-core/releases/download/${RELEASE}/v2ray-linux-${ARCH}.zip
-unzip ${SAVE_DIR}/v2ray.zip -d ${SAVE_DIR}/v2ray
+if [ "${CORE}" = "sing-box" ]; then
+  SB_NAME=sing-box-${RELEASE#v}-linux-${SB_ARCH}
+  curl -L -o ${SAVE_DIR}/sing-box.tar.gz https://github.com/SagerNet/sing-box/releases/download/${RELEASE}/${SB_NAME}.tar.gz
+  mkdir -p ${SAVE_DIR}/v2ray
+  tar -xzf ${SAVE_DIR}/sing-box.tar.gz -C ${SAVE_DIR}
+  mv ${SAVE_DIR}/${SB_NAME}/sing-box ${SAVE_DIR}/v2ray/sing-box
+  BIN=sing-box
+elif [ "${CORE}" = "xray" ]; then
+  curl -L -o ${SAVE_DIR}/v2ray.zip https://github.com/XTLS/Xray-core/releases/download/${RELEASE}/Xray-linux-${ARCH}.zip
+  BIN=xray
+else
+  curl -L -o ${SAVE_DIR}/v2ray.zip https://github.com/v2fly/v2ray-core/releases/download/${RELEASE}/v2ray-linux-${ARCH}.zip
+  BIN=v2ray
+fi
+if [ -f ${SAVE_DIR}/v2ray.zip ]; then
+  unzip ${SAVE_DIR}/v2ray.zip -d ${SAVE_DIR}/v2ray
+fi
 mkdir -p /opt/v2ray/asset
-mv ${SAVE_DIR}/v2ray/v2ray /opt/v2ray/v2ray
+mv ${SAVE_DIR}/v2ray/${BIN} /opt/v2ray/v2ray
 chmod +x /opt/v2ray/asset
 rm -rf ${SAVE_DIR}
 curl -L -o /opt/v2ray/asset/geoip.dat https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat
 curl -L -o /opt/v2ray/asset/geosite.dat https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat
+if [ "${CORE}" = "sing-box" ]; then
+  curl -L -o /opt/v2ray/asset/geoip.db https://github.com/SagerNet/sing-geoip/releases/latest/download/geoip.db
+  curl -L -o /opt/v2ray/asset/geosite.db https://github.com/SagerNet/sing-geosite/releases/latest/download/geosite.db
+fi
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"vc/protowire"
+)
+
+// The API of the cores is served over gRPC, which is http/2 without tls, with
+// protobuf messages. The few calls made are encoded by hand.
+
+// Stat is a counter of the StatsService.
+type Stat struct {
+	Name  string
+	Value int64
+}
+
+// QueryStats returns every counter of the StatsService of service, the full
+// name of the service, listening on server, resetting them if reset is true.
+func QueryStats(ctx context.Context, server string, service string, reset bool) ([]Stat, error) {
+	// QueryStatsRequest{pattern = 1, reset = 2}, the empty pattern matches
+	// every counter
+	var req []byte
+	if reset {
+		req = protowire.AppendVarintField(req, 2, 1)
+	}
+	resp, err := grpcCall(ctx, server, fmt.Sprintf("/%s/QueryStats", service), req)
+	if err != nil {
+		return nil, err
+	}
+	// QueryStatsResponse{repeated Stat stat = 1}, Stat{name = 1, value = 2}
+	var stats []Stat
+	err = protowire.Walk(resp, func(field int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		stat := Stat{}
+		err := protowire.Walk(value, func(field int, value []byte) error {
+			switch field {
+			case 1:
+				stat.Name = string(value)
+			case 2:
+				v, _ := protowire.ReadVarint(value)
+				stat.Value = int64(v)
+			}
+			return nil
+		})
+		stats = append(stats, stat)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding stats failed")
+	}
+	return stats, nil
+}
+
+var grpcClient = &http.Client{
+	Transport: func() *http.Transport {
+		protocols := &http.Protocols{}
+		protocols.SetUnencryptedHTTP2(true)
+		return &http.Transport{Protocols: protocols}
+	}(),
+}
+
+// grpcCall makes a unary call of method, like "/package.Service/Method", and
+// returns the response message.
+func grpcCall(ctx context.Context, server string, method string, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	// a message is framed by a compressed flag and its length
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+server+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "building request failed")
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := grpcClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "calling %s failed", method)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading response of %s failed", method)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("calling %s failed: %s", method, resp.Status)
+	}
+	// the status comes in the trailers, or in the headers when there is no
+	// response message
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code, err := strconv.Atoi(status); err != nil || code != 0 {
+		return nil, errors.Errorf("calling %s failed: grpc status %s %s", method, status, message)
+	}
+	if len(data) < 5 {
+		return nil, errors.Errorf("calling %s failed: no response message", method)
+	}
+	if data[0] != 0 {
+		return nil, errors.Errorf("calling %s failed: compressed response", method)
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint64(len(data)-5) < uint64(n) {
+		return nil, errors.Errorf("calling %s failed: truncated response", method)
+	}
+	return data[5 : 5+n], nil
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"vc/vc"
+)
+
+const (
+	V2ray4  = "v2ray4"
+	V2ray5  = "v2ray5"
+	Xray    = "xray"
+	SingBox = "sing-box"
+)
+
+const (
+	// FeatureApi is the gRPC HandlerService of the API, adding and removing
+	// outbounds of the running core. Outbounds are encoded in the messages of
+	// Xray, so it is the only core having it.
+	FeatureApi = "api"
+	// FeatureReality is the REALITY transport security.
+	FeatureReality = "reality"
+	// FeatureVision is the XTLS vision flow of vless.
+	FeatureVision = "vision"
+	// FeatureStats is the traffic counters of the stats and policy sections,
+	// queried through the gRPC StatsService of the API.
+	FeatureStats = "stats"
+)
+
+// Driver knows how to run a core implementation and what it supports.
+type Driver interface {
+	Name() string
+	// Args returns the command line arguments to run the core with a config
+	// file rendered by Render, and the asset directory.
+	Args(filename string, asset string) []string
+	// Env returns the environment variables to run the core with, given the
+	// asset directory.
+	Env(asset string) []string
+	// Render turns a config into what the core reads.
+	Render(cfg *vc.Config) ([]byte, error)
+	// Has reports whether the core has a feature.
+	Has(feature string) bool
+	// Supports returns an error if the core cannot run an outbound.
+	Supports(outbound *vc.Outbound) error
+	// StatsService returns the full name of the gRPC StatsService of the core
+	// to query with QueryStats, or "" if the core has no FeatureStats.
+	StatsService() string
+	// HandlerService returns the full name of the gRPC HandlerService of the
+	// core to call with AddOutbound and RemoveOutbound, or "" if the core has
+	// no FeatureApi.
+	HandlerService() string
+}
+
+// jsonDriver is a core reading the v4 json config format.
+type jsonDriver struct {
+	name      string
+	args      func(filename string) []string
+	assetEnv  string
+	protocols map[string]bool
+	features  map[string]bool
+	stats     string
+	handler   string
+}
+
+func (d *jsonDriver) Name() string {
+	return d.name
+}
+
+func (d *jsonDriver) Args(filename string, _ string) []string {
+	return d.args(filename)
+}
+
+func (d *jsonDriver) Env(asset string) []string {
+	return []string{fmt.Sprintf("%s=%s", d.assetEnv, asset)}
+}
+
+func (d *jsonDriver) Render(cfg *vc.Config) ([]byte, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling config failed")
+	}
+	return data, nil
+}
+
+func (d *jsonDriver) Has(feature string) bool {
+	return d.features[feature]
+}
+
+func (d *jsonDriver) StatsService() string {
+	return d.stats
+}
+
+func (d *jsonDriver) HandlerService() string {
+	return d.handler
+}
+
+func (d *jsonDriver) Supports(outbound *vc.Outbound) error {
+	if !d.protocols[outbound.Protocol] {
+		return errors.Errorf("protocol %s is not supported by %s", outbound.Protocol, d.name)
+	}
+	for _, feature := range Requires(outbound) {
+		if !d.features[feature] {
+			return errors.Errorf("%s is not supported by %s", feature, d.name)
+		}
+	}
+	return nil
+}
+
+// Requires returns the features an outbound needs beside its protocol.
+func Requires(outbound *vc.Outbound) []string {
+	var features []string
+	if ss := outbound.StreamSettings; ss != nil && ss.Security == "reality" {
+		features = append(features, FeatureReality)
+	}
+	if outbound.Settings != nil {
+		for _, vnext := range outbound.Settings.VNext {
+			for _, user := range vnext.Users {
+				if user.Flow != "" {
+					return append(features, FeatureVision)
+				}
+			}
+		}
+	}
+	return features
+}
+
+func set(items ...string) map[string]bool {
+	m := make(map[string]bool, len(items))
+	for _, item := range items {
+		m[item] = true
+	}
+	return m
+}
+
+var v4Protocols = []string{"blackhole", "dns", "freedom", "http", "shadowsocks", "socks", "trojan", "vless", "vmess"}
+
+var drivers = map[string]Driver{
+	V2ray4: &jsonDriver{
+		name: V2ray4,
+		args: func(filename string) []string {
+			return []string{"-config", filename}
+		},
+		assetEnv:  "V2RAY_LOCATION_ASSET",
+		protocols: set(v4Protocols...),
+		features:  set(FeatureStats),
+		stats:     "v2ray.core.app.stats.command.StatsService",
+	},
+	V2ray5: &v5Driver{},
+	Xray: &jsonDriver{
+		name: Xray,
+		args: func(filename string) []string {
+			return []string{"run", "-c", filename}
+		},
+		assetEnv:  "XRAY_LOCATION_ASSET",
+		protocols: set(append(v4Protocols, "wireguard")...),
+		features:  set(FeatureApi, FeatureReality, FeatureVision, FeatureStats),
+		stats:     "xray.app.stats.command.StatsService",
+		handler:   "xray.app.proxyman.command.HandlerService",
+	},
+	SingBox: &singBoxDriver{},
+}
+
+// Get returns the driver of a core by name.
+func Get(name string) (Driver, error) {
+	d, found := drivers[name]
+	if !found {
+		return nil, errors.Errorf("unknown core %q, available cores: %v", name, Names())
+	}
+	return d, nil
+}
+
+func Names() []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
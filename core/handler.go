@@ -0,0 +1,423 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"vc/protowire"
+	"vc/vc"
+)
+
+// Outbounds are added through the HandlerService as the protobuf messages the
+// json config of Xray is built into. Only the protocols and transports share
+// urls turn into are encoded, anything else is refused so that it is applied
+// by a restart of the core.
+
+// RemoveOutbound removes the outbound of tag through the HandlerService of
+// service, the full name of the service, listening on server.
+func RemoveOutbound(ctx context.Context, server string, service string, tag string) error {
+	// RemoveOutboundRequest{tag = 1}
+	_, err := grpcCall(ctx, server, fmt.Sprintf("/%s/RemoveOutbound", service), protowire.AppendStringField(nil, 1, tag))
+	return err
+}
+
+// AddOutbound adds outbound through the HandlerService of service, the full
+// name of the service, listening on server.
+func AddOutbound(ctx context.Context, server string, service string, outbound *vc.Outbound) error {
+	handler, err := xrayOutbound(outbound)
+	if err != nil {
+		return errors.Wrapf(err, "encoding outbound %s failed", outbound.Tag)
+	}
+	// AddOutboundRequest{outbound = 1}
+	_, err = grpcCall(ctx, server, fmt.Sprintf("/%s/AddOutbound", service), protowire.AppendBytesField(nil, 1, handler))
+	return err
+}
+
+// typedMessage encodes a TypedMessage{type = 1, value = 2} holding msg of
+// the full message name typ.
+func typedMessage(typ string, msg []byte) []byte {
+	b := protowire.AppendStringField(nil, 1, typ)
+	if len(msg) == 0 {
+		return b
+	}
+	return protowire.AppendBytesField(b, 2, msg)
+}
+
+// xrayOutbound encodes an OutboundHandlerConfig{tag = 1, sender_settings = 2,
+// proxy_settings = 3}.
+func xrayOutbound(outbound *vc.Outbound) ([]byte, error) {
+	proxy, err := xrayProxy(outbound)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := xraySender(outbound)
+	if err != nil {
+		return nil, err
+	}
+	b := protowire.AppendStringField(nil, 1, outbound.Tag)
+	b = protowire.AppendBytesField(b, 2, typedMessage("xray.app.proxyman.SenderConfig", sender))
+	return protowire.AppendBytesField(b, 3, proxy), nil
+}
+
+func xrayProxy(outbound *vc.Outbound) ([]byte, error) {
+	settings := outbound.Settings
+	if settings == nil {
+		return nil, errors.Errorf("%s outbound has no settings", outbound.Protocol)
+	}
+	switch outbound.Protocol {
+	case "vless", "vmess":
+		if len(settings.VNext) != 1 || len(settings.VNext[0].Users) != 1 {
+			return nil, errors.Errorf("%s outbound needs exactly one server and user", outbound.Protocol)
+		}
+		vnext, user := settings.VNext[0], settings.VNext[0].Users[0]
+		port, err := strconv.ParseUint(string(vnext.Port), 10, 16)
+		if err != nil {
+			return nil, errors.Errorf("invalid port %q", vnext.Port)
+		}
+		id, err := uuidOf(user.Id)
+		if err != nil {
+			return nil, err
+		}
+		if outbound.Protocol == "vless" {
+			if user.Encryption != "none" {
+				return nil, errors.Errorf("vless encryption %q is not supported", user.Encryption)
+			}
+			// Account{id = 1, flow = 2, encryption = 3}
+			account := protowire.AppendStringField(nil, 1, id)
+			if user.Flow != "" {
+				account = protowire.AppendStringField(account, 2, user.Flow)
+			}
+			account = typedMessage("xray.proxy.vless.Account", protowire.AppendStringField(account, 3, user.Encryption))
+			// Config{vnext = 1}
+			server := xrayServer(vnext.Address, port, user.Level, "", account)
+			return typedMessage("xray.proxy.vless.outbound.Config", protowire.AppendBytesField(nil, 1, server)), nil
+		}
+		// Account{id = 1, security_settings = 3}, SecurityConfig{type = 1}
+		security := protowire.AppendVarintField(nil, 1, vmessSecurity(user.Security))
+		account := protowire.AppendBytesField(protowire.AppendStringField(nil, 1, id), 3, security)
+		account = typedMessage("xray.proxy.vmess.Account", account)
+		// Config{Receiver = 1}
+		server := xrayServer(vnext.Address, port, user.Level, "", account)
+		return typedMessage("xray.proxy.vmess.outbound.Config", protowire.AppendBytesField(nil, 1, server)), nil
+	case "trojan", "shadowsocks":
+		if len(settings.Servers) != 1 {
+			return nil, errors.Errorf("%s outbound needs exactly one server", outbound.Protocol)
+		}
+		s := settings.Servers[0]
+		if s.Port <= 0 || s.Port > 65535 {
+			return nil, errors.Errorf("invalid port %d", s.Port)
+		}
+		if s.Password == "" {
+			return nil, errors.Errorf("%s outbound has no password", outbound.Protocol)
+		}
+		if outbound.Protocol == "trojan" {
+			// Account{password = 1}
+			account := typedMessage("xray.proxy.trojan.Account", protowire.AppendStringField(nil, 1, s.Password))
+			// ClientConfig{server = 1}
+			server := xrayServer(s.Address, uint64(s.Port), s.Level, s.Email, account)
+			return typedMessage("xray.proxy.trojan.ClientConfig", protowire.AppendBytesField(nil, 1, server)), nil
+		}
+		cipher := ssCipher(s.Method)
+		if cipher == 0 {
+			return nil, errors.Errorf("shadowsocks method %q is not supported", s.Method)
+		}
+		// Account{password = 1, cipher_type = 2, iv_check = 3}
+		account := protowire.AppendVarintField(protowire.AppendStringField(nil, 1, s.Password), 2, cipher)
+		account = typedMessage("xray.proxy.shadowsocks.Account", protowire.AppendBoolField(account, 3, s.IVCheck))
+		// ClientConfig{server = 1}
+		server := xrayServer(s.Address, uint64(s.Port), s.Level, s.Email, account)
+		return typedMessage("xray.proxy.shadowsocks.ClientConfig", protowire.AppendBytesField(nil, 1, server)), nil
+	default:
+		return nil, errors.Errorf("protocol %s is not supported", outbound.Protocol)
+	}
+}
+
+// xrayServer encodes a ServerEndpoint{address = 1, port = 2, user = 3}, with
+// User{level = 1, email = 2, account = 3}.
+func xrayServer(address string, port uint64, level int64, email string, account []byte) []byte {
+	user := protowire.AppendVarintField(nil, 1, uint64(level))
+	if email != "" {
+		user = protowire.AppendStringField(user, 2, email)
+	}
+	user = protowire.AppendBytesField(user, 3, account)
+	b := protowire.AppendBytesField(nil, 1, xrayAddress(address))
+	b = protowire.AppendVarintField(b, 2, port)
+	return protowire.AppendBytesField(b, 3, user)
+}
+
+// xrayAddress encodes an IPOrDomain{ip = 1, domain = 2}.
+func xrayAddress(address string) []byte {
+	ip := net.ParseIP(strings.Trim(address, "[]"))
+	if ip == nil {
+		return protowire.AppendStringField(nil, 2, address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return protowire.AppendBytesField(nil, 1, ip)
+}
+
+// uuidOf returns the canonical form of a uuid. Xray derives a uuid from other
+// short ids, which is not done here.
+func uuidOf(id string) (string, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(id, "-", ""))
+	if err != nil || len(b) != 16 {
+		return "", errors.Errorf("id %q is not a uuid", id)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// vmessSecurity returns the SecurityType of a vmess security.
+func vmessSecurity(security string) uint64 {
+	switch strings.ToLower(security) {
+	case "aes-128-gcm":
+		return 3
+	case "chacha20-poly1305":
+		return 4
+	case "none":
+		return 5
+	case "zero":
+		return 6
+	default:
+		// auto
+		return 2
+	}
+}
+
+// ssCipher returns the CipherType of a shadowsocks method, or 0 if it is not
+// supported. Shadowsocks 2022 methods are other messages, left out.
+func ssCipher(method string) uint64 {
+	switch strings.ToLower(method) {
+	case "aes-128-gcm", "aead_aes_128_gcm":
+		return 5
+	case "aes-256-gcm", "aead_aes_256_gcm":
+		return 6
+	case "chacha20-poly1305", "aead_chacha20_poly1305", "chacha20-ietf-poly1305":
+		return 7
+	case "xchacha20-poly1305", "aead_xchacha20_poly1305", "xchacha20-ietf-poly1305":
+		return 8
+	case "none", "plain":
+		return 9
+	default:
+		return 0
+	}
+}
+
+// xraySender encodes a SenderConfig{via = 1, stream_settings = 2,
+// proxy_settings = 3, multiplex_settings = 4}.
+func xraySender(outbound *vc.Outbound) ([]byte, error) {
+	var b []byte
+	if outbound.SendThrough != "" {
+		if net.ParseIP(outbound.SendThrough) == nil {
+			return nil, errors.Errorf("sending through %q is not supported", outbound.SendThrough)
+		}
+		b = protowire.AppendBytesField(b, 1, xrayAddress(outbound.SendThrough))
+	}
+	if outbound.StreamSettings != nil {
+		stream, err := xrayStream(outbound.StreamSettings)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendBytesField(b, 2, stream)
+	}
+	if ps := outbound.ProxySettings; ps != nil {
+		if ps.TransportLayer {
+			return nil, errors.Errorf("transport layer proxy is not supported")
+		}
+		// ProxyConfig{tag = 1}
+		b = protowire.AppendBytesField(b, 3, protowire.AppendStringField(nil, 1, ps.Tag))
+	}
+	if mux := outbound.Mux; mux != nil {
+		// MultiplexingConfig{enabled = 1, concurrency = 2, xudpProxyUDP443 = 4}
+		m := protowire.AppendBoolField(nil, 1, mux.Enabled)
+		if mux.Concurrency != 0 {
+			m = protowire.AppendVarintField(m, 2, uint64(mux.Concurrency))
+		}
+		b = protowire.AppendBytesField(b, 4, protowire.AppendStringField(m, 4, "reject"))
+	}
+	return b, nil
+}
+
+// xrayStream encodes a StreamConfig{transport_settings = 2, security_type = 3,
+// security_settings = 4, protocol_name = 5}, with TransportConfig{settings =
+// 2, protocol_name = 3}.
+func xrayStream(ss *vc.StreamSettings) ([]byte, error) {
+	var (
+		network   string
+		transport []byte
+	)
+	switch strings.ToLower(ss.Network) {
+	case "", "tcp", "raw":
+		network = "tcp"
+		if tcp := ss.TcpSettings; tcp != nil {
+			// Config{header_settings = 2}
+			var header []byte
+			if h := tcp.Header; h != nil {
+				if h.Type != "" && h.Type != "none" {
+					return nil, errors.Errorf("tcp header %q is not supported", h.Type)
+				}
+				header = protowire.AppendBytesField(nil, 2, typedMessage("xray.transport.internet.headers.noop.ConnectionConfig", nil))
+			}
+			transport = typedMessage("xray.transport.internet.tcp.Config", header)
+		}
+	case "ws", "websocket":
+		network = "websocket"
+		if ss.WsSettings != nil {
+			ws, err := xrayWebSocket(ss.WsSettings)
+			if err != nil {
+				return nil, err
+			}
+			transport = typedMessage("xray.transport.internet.websocket.Config", ws)
+		}
+	case "grpc":
+		network = "grpc"
+		if g := ss.GrpcSettings; g != nil {
+			// Config{service_name = 2, multi_mode = 3}
+			grpc := protowire.AppendBoolField(protowire.AppendStringField(nil, 2, g.ServiceName), 3, g.MultiMode)
+			transport = typedMessage("xray.transport.internet.grpc.encoding.Config", grpc)
+		}
+	default:
+		return nil, errors.Errorf("network %q is not supported", ss.Network)
+	}
+	var b []byte
+	if transport != nil {
+		b = protowire.AppendBytesField(b, 2, protowire.AppendStringField(protowire.AppendBytesField(nil, 2, transport), 3, network))
+	}
+	var (
+		securityType string
+		security     []byte
+		err          error
+	)
+	switch strings.ToLower(ss.Security) {
+	case "", "none":
+	case "tls":
+		securityType = "xray.transport.internet.tls.Config"
+		security, err = xrayTls(ss.TlsSettings)
+	case "reality":
+		if network != "tcp" && network != "grpc" {
+			return nil, errors.Errorf("reality over %s is not supported", network)
+		}
+		securityType = "xray.transport.internet.reality.Config"
+		security, err = xrayReality(ss.RealitySettings)
+	default:
+		return nil, errors.Errorf("security %q is not supported", ss.Security)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if securityType != "" {
+		b = protowire.AppendStringField(b, 3, securityType)
+		b = protowire.AppendBytesField(b, 4, typedMessage(securityType, security))
+	}
+	return protowire.AppendStringField(b, 5, network), nil
+}
+
+// xrayWebSocket encodes a Config{host = 1, path = 2, header = 3, ed = 5},
+// with map entries {key = 1, value = 2}. Early data is taken from the ed
+// parameter of the path, and the host from the headers, as Xray does.
+func xrayWebSocket(ws *vc.WsSettings) ([]byte, error) {
+	path, ed := ws.Path, 0
+	if u, err := url.Parse(path); err == nil {
+		if q := u.Query(); q.Get("ed") != "" {
+			ed, _ = strconv.Atoi(q.Get("ed"))
+			q.Del("ed")
+			u.RawQuery = q.Encode()
+			path = u.String()
+		}
+	}
+	keys := make([]string, 0, len(ws.Headers))
+	for k := range ws.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var (
+		host    string
+		headers []byte
+	)
+	for _, k := range keys {
+		v, ok := ws.Headers[k].(string)
+		if !ok {
+			return nil, errors.Errorf("websocket header %s is not a string", k)
+		}
+		if strings.ToLower(k) == "host" {
+			host = v
+			continue
+		}
+		headers = protowire.AppendBytesField(headers, 3, protowire.AppendStringField(protowire.AppendStringField(nil, 1, k), 2, v))
+	}
+	var b []byte
+	if host != "" {
+		b = protowire.AppendStringField(b, 1, host)
+	}
+	b = append(protowire.AppendStringField(b, 2, path), headers...)
+	if ed > 0 {
+		b = protowire.AppendVarintField(b, 5, uint64(ed))
+	}
+	return b, nil
+}
+
+// xrayTls encodes a Config{allow_insecure = 1, server_name = 3,
+// next_protocol = 4, disable_system_root = 6, fingerprint = 11}.
+func xrayTls(tls *vc.TlsSettings) ([]byte, error) {
+	if tls == nil {
+		return nil, nil
+	}
+	if len(tls.Certificates) > 0 || tls.PinnedPeerCertificateChainSha256 != "" {
+		return nil, errors.Errorf("tls certificates are not supported")
+	}
+	b := protowire.AppendBoolField(nil, 1, tls.AllowInsecure)
+	if tls.ServerName != "" {
+		b = protowire.AppendStringField(b, 3, tls.ServerName)
+	}
+	for _, alpn := range tls.Alpn {
+		b = protowire.AppendStringField(b, 4, alpn)
+	}
+	b = protowire.AppendBoolField(b, 6, tls.DisableSystemRoot)
+	if tls.Fingerprint != "" {
+		b = protowire.AppendStringField(b, 11, strings.ToLower(tls.Fingerprint))
+	}
+	return b, nil
+}
+
+// xrayReality encodes a client Config{Fingerprint = 21, server_name = 22,
+// public_key = 23, short_id = 24, spider_x = 26, spider_y = 27}.
+func xrayReality(reality *vc.RealitySettings) ([]byte, error) {
+	if reality == nil {
+		return nil, errors.Errorf("reality has no settings")
+	}
+	publicKey, err := base64.RawURLEncoding.DecodeString(reality.PublicKey)
+	if err != nil || len(publicKey) != 32 {
+		return nil, errors.Errorf("invalid reality public key %q", reality.PublicKey)
+	}
+	shortId := make([]byte, 8)
+	if len(reality.ShortId) > 16 {
+		return nil, errors.Errorf("invalid reality short id %q", reality.ShortId)
+	}
+	if _, err := hex.Decode(shortId, []byte(reality.ShortId)); err != nil {
+		return nil, errors.Errorf("invalid reality short id %q", reality.ShortId)
+	}
+	spiderX := reality.SpiderX
+	if spiderX == "" {
+		spiderX = "/"
+	}
+	u, err := url.Parse(spiderX)
+	if err != nil || spiderX[0] != '/' || u.RawQuery != "" {
+		return nil, errors.Errorf("reality spider %q is not supported", reality.SpiderX)
+	}
+	b := protowire.AppendStringField(nil, 21, strings.ToLower(reality.Fingerprint))
+	if reality.ServerName != "" {
+		b = protowire.AppendStringField(b, 22, reality.ServerName)
+	}
+	b = protowire.AppendBytesField(b, 23, publicKey)
+	b = protowire.AppendBytesField(b, 24, shortId)
+	b = protowire.AppendStringField(b, 26, u.String())
+	// the spider parameters are indexed by the core, so all 10 are sent
+	return protowire.AppendBytesField(b, 27, make([]byte, 10)), nil
+}
@@ -0,0 +1,497 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"vc/vc"
+)
+
+// singBoxDriver runs sing-box, translating the v2ray config into its schema.
+// Balancers become urltest outbounds, as sing-box has no random balancer.
+type singBoxDriver struct{}
+
+func (d *singBoxDriver) Name() string {
+	return SingBox
+}
+
+func (d *singBoxDriver) Args(filename string, asset string) []string {
+	// geoip.db and geosite.db are looked up in the working directory
+	return []string{"run", "-c", filename, "-D", asset}
+}
+
+func (d *singBoxDriver) Env(string) []string {
+	return nil
+}
+
+func (d *singBoxDriver) Has(feature string) bool {
+	return feature == FeatureReality || feature == FeatureVision
+}
+
+// StatsService returns "", the v2ray api of sing-box is a build option left
+// out of release builds.
+func (d *singBoxDriver) StatsService() string {
+	return ""
+}
+
+// HandlerService returns "", outbounds are not encoded for sing-box.
+func (d *singBoxDriver) HandlerService() string {
+	return ""
+}
+
+func (d *singBoxDriver) Supports(outbound *vc.Outbound) error {
+	_, err := sbOutboundOf(outbound)
+	return err
+}
+
+func (d *singBoxDriver) Render(cfg *vc.Config) ([]byte, error) {
+	sb := &sbConfig{
+		Log:   &sbLog{Level: "info", DisableColor: true},
+		Route: &sbRoute{},
+	}
+	if cfg.Log != nil && cfg.Log.LogLevel != "" {
+		sb.Log.Level = cfg.Log.LogLevel
+		switch cfg.Log.LogLevel {
+		case "warning":
+			sb.Log.Level = "warn"
+		case "none":
+			sb.Log.Disabled = true
+		}
+	}
+	if cfg.Dns != nil {
+		dns, err := sbDnsOf(cfg.Dns)
+		if err != nil {
+			return nil, err
+		}
+		sb.Dns = dns
+	}
+	for _, inbound := range cfg.Inbounds {
+		in, err := sbInboundOf(inbound)
+		if err != nil {
+			return nil, err
+		}
+		sb.Inbounds = append(sb.Inbounds, in)
+	}
+	for _, outbound := range cfg.Outbounds {
+		out, err := sbOutboundOf(outbound)
+		if err != nil {
+			return nil, err
+		}
+		sb.Outbounds = append(sb.Outbounds, out)
+	}
+	if len(sb.Outbounds) > 0 {
+		sb.Route.Final = sb.Outbounds[0].Tag
+	}
+	if cfg.Routing != nil {
+		for _, b := range cfg.Routing.Balancers {
+			var tags []string
+			for _, outbound := range cfg.Outbounds {
+				for _, prefix := range b.Selector {
+					if strings.HasPrefix(outbound.Tag, prefix) {
+						tags = append(tags, outbound.Tag)
+						break
+					}
+				}
+			}
+			if len(tags) == 0 {
+				return nil, errors.Errorf("balancer %s selects no outbound", b.Tag)
+			}
+			sb.Outbounds = append(sb.Outbounds, &sbOutbound{Type: "urltest", Tag: b.Tag, Outbounds: tags})
+		}
+		for _, rule := range cfg.Routing.Rules {
+			r, err := sbRuleOf(rule)
+			if err != nil {
+				return nil, err
+			}
+			sb.Route.Rules = append(sb.Route.Rules, r)
+		}
+	}
+	data, err := json.Marshal(sb)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling sing-box config failed")
+	}
+	return data, nil
+}
+
+type sbConfig struct {
+	Log       *sbLog        `json:"log,omitempty"`
+	Dns       *sbDns        `json:"dns,omitempty"`
+	Inbounds  []*sbInbound  `json:"inbounds,omitempty"`
+	Outbounds []*sbOutbound `json:"outbounds,omitempty"`
+	Route     *sbRoute      `json:"route,omitempty"`
+}
+
+type sbLog struct {
+	Disabled     bool   `json:"disabled,omitempty"`
+	Level        string `json:"level,omitempty"`
+	DisableColor bool   `json:"disable_color,omitempty"`
+}
+
+type sbDns struct {
+	Servers []*sbDnsServer `json:"servers,omitempty"`
+}
+
+type sbDnsServer struct {
+	Tag     string `json:"tag,omitempty"`
+	Address string `json:"address"`
+}
+
+type sbInbound struct {
+	Type                     string    `json:"type"`
+	Tag                      string    `json:"tag,omitempty"`
+	Listen                   string    `json:"listen"`
+	ListenPort               int       `json:"listen_port"`
+	Sniff                    bool      `json:"sniff,omitempty"`
+	SniffOverrideDestination bool      `json:"sniff_override_destination,omitempty"`
+	Users                    []*sbUser `json:"users,omitempty"`
+	Network                  string    `json:"network,omitempty"`
+	OverrideAddress          string    `json:"override_address,omitempty"`
+}
+
+type sbUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type sbOutbound struct {
+	Type       string       `json:"type"`
+	Tag        string       `json:"tag"`
+	Server     string       `json:"server,omitempty"`
+	ServerPort int          `json:"server_port,omitempty"`
+	Method     string       `json:"method,omitempty"`
+	Password   string       `json:"password,omitempty"`
+	UUID       string       `json:"uuid,omitempty"`
+	Security   string       `json:"security,omitempty"`
+	AlterId    int          `json:"alter_id,omitempty"`
+	Flow       string       `json:"flow,omitempty"`
+	TLS        *sbTLS       `json:"tls,omitempty"`
+	Transport  *sbTransport `json:"transport,omitempty"`
+	Outbounds  []string     `json:"outbounds,omitempty"`
+}
+
+type sbTLS struct {
+	Enabled    bool       `json:"enabled"`
+	ServerName string     `json:"server_name,omitempty"`
+	Insecure   bool       `json:"insecure,omitempty"`
+	Alpn       []string   `json:"alpn,omitempty"`
+	UTLS       *sbUTLS    `json:"utls,omitempty"`
+	Reality    *sbReality `json:"reality,omitempty"`
+}
+
+type sbUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type sbReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortId   string `json:"short_id,omitempty"`
+}
+
+type sbTransport struct {
+	Type        string            `json:"type"`
+	Path        string            `json:"path,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Host        []string          `json:"host,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+}
+
+type sbRoute struct {
+	Rules []*sbRule `json:"rules,omitempty"`
+	Final string    `json:"final,omitempty"`
+}
+
+type sbRule struct {
+	Inbound       []string `json:"inbound,omitempty"`
+	Network       string   `json:"network,omitempty"`
+	Protocol      []string `json:"protocol,omitempty"`
+	Domain        []string `json:"domain,omitempty"`
+	DomainSuffix  []string `json:"domain_suffix,omitempty"`
+	DomainKeyword []string `json:"domain_keyword,omitempty"`
+	DomainRegex   []string `json:"domain_regex,omitempty"`
+	Geosite       []string `json:"geosite,omitempty"`
+	Geoip         []string `json:"geoip,omitempty"`
+	SourceIpCidr  []string `json:"source_ip_cidr,omitempty"`
+	IpCidr        []string `json:"ip_cidr,omitempty"`
+	Port          []int    `json:"port,omitempty"`
+	PortRange     []string `json:"port_range,omitempty"`
+	Outbound      string   `json:"outbound"`
+}
+
+func sbDnsOf(dns *vc.Dns) (*sbDns, error) {
+	sb := &sbDns{}
+	for i, server := range dns.Servers {
+		data, err := json.Marshal(server)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshalling dns server failed")
+		}
+		var address string
+		complexServer := &vc.ComplexServer{}
+		if err := json.Unmarshal(data, &address); err != nil {
+			if err := json.Unmarshal(data, complexServer); err != nil {
+				return nil, errors.Wrap(err, "decoding dns server failed")
+			}
+			address = complexServer.Address
+			if complexServer.Port != 0 {
+				address = fmt.Sprintf("udp://%s:%d", address, complexServer.Port)
+			}
+		}
+		if address == "localhost" {
+			address = "local"
+		}
+		address = strings.Replace(address, "+local://", "://", 1)
+		sb.Servers = append(sb.Servers, &sbDnsServer{Tag: fmt.Sprintf("dns-%d", i), Address: address})
+	}
+	return sb, nil
+}
+
+func sbInboundOf(inbound *vc.Inbound) (*sbInbound, error) {
+	port, err := strconv.Atoi(fmt.Sprint(inbound.Port))
+	if err != nil {
+		return nil, errors.Errorf("port %v of inbound %s is not supported by sing-box", inbound.Port, inbound.Tag)
+	}
+	in := &sbInbound{Tag: inbound.Tag, Listen: inbound.Listen, ListenPort: port}
+	if in.Listen == "" {
+		in.Listen = "0.0.0.0"
+	}
+	if inbound.Sniffing != nil && inbound.Sniffing.Enabled {
+		in.Sniff = true
+		in.SniffOverrideDestination = !inbound.Sniffing.MetadataOnly
+	}
+	settings := inbound.Settings
+	if settings == nil {
+		settings = &vc.InboundCommonSettings{}
+	}
+	switch inbound.Protocol {
+	case "socks", "http":
+		in.Type = inbound.Protocol
+		for _, account := range settings.Accounts {
+			in.Users = append(in.Users, &sbUser{Username: account.User, Password: account.Pass})
+		}
+	case "dokodemo-door":
+		in.Type = "direct"
+		in.OverrideAddress = settings.Address
+		if settings.Network != "tcp,udp" {
+			in.Network = settings.Network
+		}
+	default:
+		return nil, errors.Errorf("inbound protocol %s is not supported by sing-box", inbound.Protocol)
+	}
+	return in, nil
+}
+
+// sbSsMethods maps the shadowsocks ciphers of v2ray and xray to the names
+// sing-box knows them by.
+var sbSsMethods = map[string]string{
+	"none":                          "none",
+	"plain":                         "none",
+	"aes-128-gcm":                   "aes-128-gcm",
+	"aes-192-gcm":                   "aes-192-gcm",
+	"aes-256-gcm":                   "aes-256-gcm",
+	"chacha20-poly1305":             "chacha20-ietf-poly1305",
+	"chacha20-ietf-poly1305":        "chacha20-ietf-poly1305",
+	"xchacha20-poly1305":            "xchacha20-ietf-poly1305",
+	"xchacha20-ietf-poly1305":       "xchacha20-ietf-poly1305",
+	"2022-blake3-aes-128-gcm":       "2022-blake3-aes-128-gcm",
+	"2022-blake3-aes-256-gcm":       "2022-blake3-aes-256-gcm",
+	"2022-blake3-chacha20-poly1305": "2022-blake3-chacha20-poly1305",
+}
+
+func sbSsMethodOf(method string) (string, error) {
+	if m, found := sbSsMethods[strings.ToLower(method)]; found {
+		return m, nil
+	}
+	return "", errors.Errorf("shadowsocks cipher %s is not supported by sing-box", method)
+}
+
+func sbOutboundOf(outbound *vc.Outbound) (*sbOutbound, error) {
+	out := &sbOutbound{Tag: outbound.Tag}
+	settings := outbound.Settings
+	if settings == nil {
+		settings = &vc.OutboundCommonSettings{}
+	}
+	switch outbound.Protocol {
+	case "freedom":
+		out.Type = "direct"
+		return out, nil
+	case "blackhole":
+		out.Type = "block"
+		return out, nil
+	case "dns":
+		out.Type = "dns"
+		return out, nil
+	case "shadowsocks", "trojan":
+		if len(settings.Servers) != 1 {
+			return nil, errors.Errorf("outbound %s should have exactly one server", outbound.Tag)
+		}
+		server := settings.Servers[0]
+		out.Type = outbound.Protocol
+		out.Server, out.ServerPort = server.Address, int(server.Port)
+		out.Password = server.Password
+		if outbound.Protocol == "shadowsocks" {
+			method, err := sbSsMethodOf(server.Method)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "outbound %s", outbound.Tag)
+			}
+			out.Method = method
+		}
+	case "vmess", "vless":
+		if len(settings.VNext) != 1 || len(settings.VNext[0].Users) != 1 {
+			return nil, errors.Errorf("outbound %s should have exactly one server and user", outbound.Tag)
+		}
+		vnext, user := settings.VNext[0], settings.VNext[0].Users[0]
+		port, err := vnext.Port.Int64()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid port of outbound %s", outbound.Tag)
+		}
+		out.Type = outbound.Protocol
+		out.Server, out.ServerPort, out.UUID = vnext.Address, int(port), user.Id
+		if outbound.Protocol == "vmess" {
+			out.Security = user.Security
+			if aid, err := user.AlterId.Int64(); err == nil {
+				out.AlterId = int(aid)
+			}
+		} else {
+			out.Flow = user.Flow
+		}
+	default:
+		return nil, errors.Errorf("protocol %s is not supported by sing-box", outbound.Protocol)
+	}
+	if outbound.StreamSettings != nil {
+		tls, transport, err := sbStreamOf(outbound.StreamSettings)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "outbound %s", outbound.Tag)
+		}
+		out.TLS, out.Transport = tls, transport
+	}
+	return out, nil
+}
+
+func sbStreamOf(ss *vc.StreamSettings) (*sbTLS, *sbTransport, error) {
+	var transport *sbTransport
+	switch ss.Network {
+	case "", "tcp":
+		if ss.TcpSettings != nil && ss.TcpSettings.Header != nil && ss.TcpSettings.Header.Type == "http" {
+			return nil, nil, errors.Errorf("http header obfuscation is not supported by sing-box")
+		}
+	case "ws":
+		transport = &sbTransport{Type: "ws"}
+		if ws := ss.WsSettings; ws != nil {
+			transport.Path = ws.Path
+			if host, ok := ws.Headers["Host"].(string); ok && host != "" {
+				transport.Headers = map[string]string{"Host": host}
+			}
+		}
+	case "http", "h2":
+		transport = &sbTransport{Type: "http"}
+		if h := ss.HttpSettings; h != nil {
+			transport.Path = h.Path
+			for _, host := range h.Host {
+				if host != "" {
+					transport.Host = append(transport.Host, host)
+				}
+			}
+		}
+	case "grpc":
+		transport = &sbTransport{Type: "grpc"}
+		if ss.GrpcSettings != nil {
+			transport.ServiceName = ss.GrpcSettings.ServiceName
+		}
+	default:
+		return nil, nil, errors.Errorf("network %s is not supported by sing-box", ss.Network)
+	}
+	switch ss.Security {
+	case "", "none":
+		return nil, transport, nil
+	case "tls":
+		tls := &sbTLS{Enabled: true}
+		if t := ss.TlsSettings; t != nil {
+			tls.ServerName, tls.Insecure, tls.Alpn = t.ServerName, t.AllowInsecure, t.Alpn
+			if t.Fingerprint != "" {
+				tls.UTLS = &sbUTLS{Enabled: true, Fingerprint: t.Fingerprint}
+			}
+		}
+		return tls, transport, nil
+	case "reality":
+		r := ss.RealitySettings
+		if r == nil {
+			return nil, nil, errors.Errorf("reality settings missing")
+		}
+		fingerprint := r.Fingerprint
+		if fingerprint == "" {
+			// reality needs uTLS in sing-box
+			fingerprint = "chrome"
+		}
+		return &sbTLS{
+			Enabled:    true,
+			ServerName: r.ServerName,
+			UTLS:       &sbUTLS{Enabled: true, Fingerprint: fingerprint},
+			Reality:    &sbReality{Enabled: true, PublicKey: r.PublicKey, ShortId: r.ShortId},
+		}, transport, nil
+	default:
+		return nil, nil, errors.Errorf("security %s is not supported by sing-box", ss.Security)
+	}
+}
+
+func sbRuleOf(rule *vc.Rule) (*sbRule, error) {
+	r := &sbRule{
+		Inbound:      rule.InboundTag,
+		Network:      rule.Network,
+		Protocol:     rule.Protocol,
+		SourceIpCidr: rule.Source,
+		Outbound:     rule.OutboundTag,
+	}
+	if rule.BalancerTag != "" {
+		r.Outbound = rule.BalancerTag
+	}
+	if rule.Network == "tcp,udp" {
+		r.Network = ""
+	}
+	if rule.Attrs != "" || len(rule.User) > 0 || rule.SourcePort != nil {
+		return nil, errors.Errorf("rule to %s has conditions not supported by sing-box", r.Outbound)
+	}
+	for _, domain := range rule.Domains {
+		kind, value, found := strings.Cut(domain, ":")
+		switch {
+		case !found:
+			r.DomainKeyword = append(r.DomainKeyword, domain)
+		case kind == "domain":
+			r.DomainSuffix = append(r.DomainSuffix, value)
+		case kind == "full":
+			r.Domain = append(r.Domain, value)
+		case kind == "keyword":
+			r.DomainKeyword = append(r.DomainKeyword, value)
+		case kind == "regexp":
+			r.DomainRegex = append(r.DomainRegex, value)
+		case kind == "geosite":
+			r.Geosite = append(r.Geosite, value)
+		default:
+			return nil, errors.Errorf("domain %s is not supported by sing-box", domain)
+		}
+	}
+	for _, ip := range rule.IP {
+		if strings.HasPrefix(ip, "geoip:") {
+			r.Geoip = append(r.Geoip, strings.TrimPrefix(ip, "geoip:"))
+		} else {
+			r.IpCidr = append(r.IpCidr, ip)
+		}
+	}
+	if rule.Port != nil {
+		for _, p := range strings.Split(fmt.Sprint(rule.Port), ",") {
+			p = strings.TrimSpace(p)
+			if from, to, found := strings.Cut(p, "-"); found {
+				r.PortRange = append(r.PortRange, from+":"+to)
+				continue
+			}
+			port, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, errors.Errorf("port %v is not supported by sing-box", rule.Port)
+			}
+			r.Port = append(r.Port, port)
+		}
+	}
+	return r, nil
+}
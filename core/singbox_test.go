@@ -0,0 +1,89 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"vc/vc"
+)
+
+func TestSingBoxRender(t *testing.T) {
+	cfg := &vc.Config{}
+	err := json.Unmarshal([]byte(`{
+		"log": {"loglevel": "warning"},
+		"inbounds": [{"tag": "socks", "listen": "127.0.0.1", "port": 1080, "protocol": "socks"}],
+		"outbounds": [
+			{"tag": "proxy-a", "protocol": "vless",
+				"settings": {"vnext": [{"address": "a.example.com", "port": 443, "users": [{"id": "uuid", "flow": "xtls-rprx-vision"}]}]},
+				"streamSettings": {"network": "ws", "security": "tls",
+					"tlsSettings": {"serverName": "cdn.example.com", "fingerprint": "firefox"},
+					"wsSettings": {"path": "/ws", "headers": {"Host": "cdn.example.com"}}}},
+			{"tag": "proxy-b", "protocol": "shadowsocks",
+				"settings": {"servers": [{"address": "b.example.com", "port": 8388, "method": "chacha20-poly1305", "password": "secret"}]}},
+			{"tag": "direct", "protocol": "freedom"}
+		],
+		"routing": {"balancers": [{"tag": "main", "selector": ["proxy-"]}]}
+	}`), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver, _ := Get(SingBox)
+	data, err := driver.Render(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := &sbConfig{}
+	if err := json.Unmarshal(data, sb); err != nil {
+		t.Fatal(err)
+	}
+	if sb.Log.Level != "warn" {
+		t.Errorf("log level = %s, want warn", sb.Log.Level)
+	}
+	if in := sb.Inbounds[0]; in.Type != "socks" || in.Listen != "127.0.0.1" || in.ListenPort != 1080 {
+		t.Errorf("inbound = %+v, want socks on 127.0.0.1:1080", in)
+	}
+	want := []*sbOutbound{
+		{
+			Type: "vless", Tag: "proxy-a", Server: "a.example.com", ServerPort: 443, UUID: "uuid", Flow: "xtls-rprx-vision",
+			TLS:       &sbTLS{Enabled: true, ServerName: "cdn.example.com", UTLS: &sbUTLS{Enabled: true, Fingerprint: "firefox"}},
+			Transport: &sbTransport{Type: "ws", Path: "/ws", Headers: map[string]string{"Host": "cdn.example.com"}},
+		},
+		{Type: "shadowsocks", Tag: "proxy-b", Server: "b.example.com", ServerPort: 8388, Method: "chacha20-ietf-poly1305", Password: "secret"},
+		{Type: "direct", Tag: "direct"},
+		{Type: "urltest", Tag: "main", Outbounds: []string{"proxy-a", "proxy-b"}},
+	}
+	if len(sb.Outbounds) != len(want) {
+		t.Fatalf("got %d outbounds, want %d", len(sb.Outbounds), len(want))
+	}
+	for i, out := range sb.Outbounds {
+		if !reflect.DeepEqual(out, want[i]) {
+			t.Errorf("outbound %d = %+v, want %+v", i, out, want[i])
+		}
+	}
+	if sb.Route.Final != "proxy-a" {
+		t.Errorf("final outbound = %s, want proxy-a", sb.Route.Final)
+	}
+}
+
+func TestSbSsMethodOf(t *testing.T) {
+	tests := []struct {
+		method  string
+		want    string
+		wantErr bool
+	}{
+		{method: "aes-256-gcm", want: "aes-256-gcm"},
+		{method: "AES-128-GCM", want: "aes-128-gcm"},
+		{method: "chacha20-poly1305", want: "chacha20-ietf-poly1305"},
+		{method: "xchacha20-poly1305", want: "xchacha20-ietf-poly1305"},
+		{method: "plain", want: "none"},
+		{method: "2022-blake3-aes-256-gcm", want: "2022-blake3-aes-256-gcm"},
+		{method: "aes-256-cfb", wantErr: true},
+		{method: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := sbSsMethodOf(tt.method)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("sbSsMethodOf(%q) = %q, %v, want %q", tt.method, got, err, tt.want)
+		}
+	}
+}
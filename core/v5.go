@@ -0,0 +1,511 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"vc/vc"
+)
+
+// v5Driver runs v2ray v5 with the config rendered in its jsonv5 schema.
+type v5Driver struct{}
+
+func (d *v5Driver) Name() string {
+	return V2ray5
+}
+
+func (d *v5Driver) Args(filename string, _ string) []string {
+	return []string{"run", "-c", filename, "-format", "jsonv5"}
+}
+
+func (d *v5Driver) Env(asset string) []string {
+	return []string{fmt.Sprintf("V2RAY_LOCATION_ASSET=%s", asset)}
+}
+
+func (d *v5Driver) Has(feature string) bool {
+	return feature == FeatureApi
+}
+
+// StatsService returns "", the stats and policy sections are not rendered in
+// jsonv5.
+func (d *v5Driver) StatsService() string {
+	return ""
+}
+
+// HandlerService returns "", outbounds are not encoded for v2ray 5.
+func (d *v5Driver) HandlerService() string {
+	return ""
+}
+
+// Supports is called for every endpoint of the subscription before the config
+// is built, so that endpoints v5 cannot run, like legacy vmess ones, are
+// skipped one by one instead of failing the rendering of the whole config.
+func (d *v5Driver) Supports(outbound *vc.Outbound) error {
+	_, err := v5OutboundOf(outbound)
+	return err
+}
+
+func (d *v5Driver) Render(cfg *vc.Config) ([]byte, error) {
+	v5 := &v5Config{}
+	if cfg.Log != nil {
+		v5.Log = v5LogOf(cfg.Log)
+	}
+	if cfg.Api != nil {
+		v5.Services = map[string]any{
+			"api": map[string]any{"tag": cfg.Api.Tag, "name": cfg.Api.Services},
+		}
+	}
+	if cfg.Dns != nil {
+		dns, err := v5DnsOf(cfg.Dns)
+		if err != nil {
+			return nil, err
+		}
+		v5.Dns = dns
+	}
+	for _, inbound := range cfg.Inbounds {
+		in, err := v5InboundOf(inbound)
+		if err != nil {
+			return nil, err
+		}
+		v5.Inbounds = append(v5.Inbounds, in)
+	}
+	for _, outbound := range cfg.Outbounds {
+		out, err := v5OutboundOf(outbound)
+		if err != nil {
+			return nil, err
+		}
+		v5.Outbounds = append(v5.Outbounds, out)
+	}
+	if cfg.Routing != nil {
+		v5.Router = &v5Router{DomainStrategy: cfg.Routing.DomainStrategy}
+		for _, rule := range cfg.Routing.Rules {
+			r, err := v5RuleOf(rule)
+			if err != nil {
+				return nil, err
+			}
+			v5.Router.Rule = append(v5.Router.Rule, r)
+		}
+		for _, b := range cfg.Routing.Balancers {
+			rule := &v5BalancingRule{Tag: b.Tag, OutboundSelector: b.Selector}
+			if b.Strategy != nil {
+				rule.Strategy = strings.ToLower(b.Strategy.Type)
+			}
+			v5.Router.BalancingRule = append(v5.Router.BalancingRule, rule)
+		}
+	}
+	data, err := json.Marshal(v5)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling jsonv5 config failed")
+	}
+	return data, nil
+}
+
+type v5Config struct {
+	Log       *v5Log         `json:"log,omitempty"`
+	Dns       *v5Dns         `json:"dns,omitempty"`
+	Router    *v5Router      `json:"router,omitempty"`
+	Inbounds  []*v5Inbound   `json:"inbounds,omitempty"`
+	Outbounds []*v5Outbound  `json:"outbounds,omitempty"`
+	Services  map[string]any `json:"services,omitempty"`
+}
+
+type v5Log struct {
+	Access *v5LogTarget `json:"access,omitempty"`
+	Error  *v5LogTarget `json:"error,omitempty"`
+}
+
+type v5LogTarget struct {
+	Type  string `json:"type"`
+	Level string `json:"level,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
+type v5Dns struct {
+	NameServer []*v5NameServer `json:"nameServer,omitempty"`
+}
+
+type v5NameServer struct {
+	Address *v5Endpoint `json:"address"`
+}
+
+type v5Endpoint struct {
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+}
+
+type v5Router struct {
+	DomainStrategy string             `json:"domainStrategy,omitempty"`
+	Rule           []*v5Rule          `json:"rule,omitempty"`
+	BalancingRule  []*v5BalancingRule `json:"balancingRule,omitempty"`
+}
+
+type v5Rule struct {
+	Tag          string         `json:"tag,omitempty"`
+	BalancingTag string         `json:"balancingTag,omitempty"`
+	Domain       []*v5Domain    `json:"domain,omitempty"`
+	GeoDomain    []*v5GeoDomain `json:"geoDomain,omitempty"`
+	Geoip        []*v5GeoIP     `json:"geoip,omitempty"`
+	PortList     string         `json:"portList,omitempty"`
+	Networks     string         `json:"networks,omitempty"`
+	SourceGeoip  []*v5GeoIP     `json:"sourceGeoip,omitempty"`
+	UserEmail    []string       `json:"userEmail,omitempty"`
+	InboundTag   []string       `json:"inboundTag,omitempty"`
+	Protocol     []string       `json:"protocol,omitempty"`
+	Attributes   string         `json:"attributes,omitempty"`
+}
+
+type v5Domain struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type v5GeoDomain struct {
+	Code string `json:"code"`
+}
+
+type v5GeoIP struct {
+	Code string    `json:"code,omitempty"`
+	Cidr []*v5Cidr `json:"cidr,omitempty"`
+}
+
+type v5Cidr struct {
+	IpAddr string `json:"ipAddr"`
+	Prefix int    `json:"prefix"`
+}
+
+type v5BalancingRule struct {
+	Tag              string   `json:"tag"`
+	OutboundSelector []string `json:"outboundSelector"`
+	Strategy         string   `json:"strategy,omitempty"`
+}
+
+type v5Inbound struct {
+	Protocol string         `json:"protocol"`
+	Settings map[string]any `json:"settings,omitempty"`
+	Port     any            `json:"port"`
+	Listen   string         `json:"listen,omitempty"`
+	Tag      string         `json:"tag,omitempty"`
+	Sniffing *vc.Sniffing   `json:"sniffing,omitempty"`
+}
+
+type v5Outbound struct {
+	Protocol       string            `json:"protocol"`
+	Settings       map[string]any    `json:"settings,omitempty"`
+	SendThrough    string            `json:"sendThrough,omitempty"`
+	Tag            string            `json:"tag,omitempty"`
+	StreamSettings *v5StreamSettings `json:"streamSettings,omitempty"`
+}
+
+type v5StreamSettings struct {
+	Transport         string         `json:"transport,omitempty"`
+	TransportSettings map[string]any `json:"transportSettings,omitempty"`
+	Security          string         `json:"security,omitempty"`
+	SecuritySettings  map[string]any `json:"securitySettings,omitempty"`
+}
+
+func v5LogOf(log *vc.Log) *v5Log {
+	target := func(path string) *v5LogTarget {
+		switch path {
+		case "":
+			return &v5LogTarget{Type: "Console"}
+		case "none":
+			return &v5LogTarget{Type: "None"}
+		default:
+			return &v5LogTarget{Type: "File", Path: path}
+		}
+	}
+	v5 := &v5Log{Access: target(log.Access), Error: target(log.Error)}
+	switch log.LogLevel {
+	case "":
+		v5.Error.Level = "Warning"
+	case "none":
+		v5.Error.Type = "None"
+	default:
+		v5.Error.Level = strings.ToUpper(log.LogLevel[:1]) + log.LogLevel[1:]
+	}
+	return v5
+}
+
+func v5DnsOf(dns *vc.Dns) (*v5Dns, error) {
+	v5 := &v5Dns{}
+	for _, server := range dns.Servers {
+		data, err := json.Marshal(server)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshalling dns server failed")
+		}
+		endpoint := &v5Endpoint{}
+		var address string
+		if err := json.Unmarshal(data, &address); err == nil {
+			endpoint.Address = address
+		} else {
+			complexServer := &vc.ComplexServer{}
+			if err := json.Unmarshal(data, complexServer); err != nil {
+				return nil, errors.Wrap(err, "decoding dns server failed")
+			}
+			endpoint.Address, endpoint.Port = complexServer.Address, int(complexServer.Port)
+		}
+		switch {
+		case endpoint.Address == "localhost", endpoint.Address == "fakedns":
+		case net.ParseIP(endpoint.Address) != nil:
+			if endpoint.Port == 0 {
+				endpoint.Port = 53
+			}
+		case v5DnsUrl(endpoint.Address):
+			// v5 takes the url of doh, dns over quic and dns over tcp
+			// servers as the address of the endpoint, like v4 does
+		default:
+			return nil, errors.Errorf("dns server %s is not supported by jsonv5 rendering", endpoint.Address)
+		}
+		v5.NameServer = append(v5.NameServer, &v5NameServer{Address: endpoint})
+	}
+	return v5, nil
+}
+
+// v5DnsUrl tells whether address is the url of a dns server v5 queries over
+// https, quic or tcp.
+func v5DnsUrl(address string) bool {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https", "https+local", "quic+local", "tcp", "tcp+local":
+		return true
+	}
+	return false
+}
+
+func v5InboundOf(inbound *vc.Inbound) (*v5Inbound, error) {
+	in := &v5Inbound{
+		Protocol: inbound.Protocol,
+		Settings: map[string]any{},
+		Port:     inbound.Port,
+		Listen:   inbound.Listen,
+		Tag:      inbound.Tag,
+		Sniffing: inbound.Sniffing,
+	}
+	if inbound.StreamSettings != nil {
+		return nil, errors.Errorf("stream settings of inbound %s are not supported by jsonv5 rendering", inbound.Tag)
+	}
+	settings := inbound.Settings
+	if settings == nil {
+		settings = &vc.InboundCommonSettings{}
+	}
+	switch inbound.Protocol {
+	case "socks":
+		if len(settings.Accounts) > 0 {
+			return nil, errors.Errorf("accounts of socks inbound %s are not supported by jsonv5 rendering", inbound.Tag)
+		}
+		if settings.IP != "" {
+			in.Settings["address"] = settings.IP
+		}
+		if settings.Udp {
+			in.Settings["udpEnabled"] = true
+		}
+	case "http":
+		if len(settings.Accounts) > 0 {
+			return nil, errors.Errorf("accounts of http inbound %s are not supported by jsonv5 rendering", inbound.Tag)
+		}
+	case "dokodemo-door":
+		in.Settings["address"] = settings.Address
+	default:
+		return nil, errors.Errorf("inbound protocol %s is not supported by jsonv5 rendering", inbound.Protocol)
+	}
+	return in, nil
+}
+
+func v5OutboundOf(outbound *vc.Outbound) (*v5Outbound, error) {
+	out := &v5Outbound{
+		Protocol: outbound.Protocol,
+		Settings: map[string]any{},
+		Tag:      outbound.Tag,
+	}
+	if outbound.SendThrough != "0.0.0.0" {
+		out.SendThrough = outbound.SendThrough
+	}
+	settings := outbound.Settings
+	if settings == nil {
+		settings = &vc.OutboundCommonSettings{}
+	}
+	switch outbound.Protocol {
+	case "freedom", "blackhole", "dns":
+		return out, nil
+	case "shadowsocks", "trojan":
+		if len(settings.Servers) != 1 {
+			return nil, errors.Errorf("outbound %s should have exactly one server", outbound.Tag)
+		}
+		server := settings.Servers[0]
+		out.Settings["address"], out.Settings["port"] = server.Address, server.Port
+		out.Settings["password"] = server.Password
+		if outbound.Protocol == "shadowsocks" {
+			out.Settings["method"] = server.Method
+		}
+	case "vmess", "vless":
+		if len(settings.VNext) != 1 || len(settings.VNext[0].Users) != 1 {
+			return nil, errors.Errorf("outbound %s should have exactly one server and user", outbound.Tag)
+		}
+		vnext, user := settings.VNext[0], settings.VNext[0].Users[0]
+		port, err := vnext.Port.Int64()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid port of outbound %s", outbound.Tag)
+		}
+		if aid, err := user.AlterId.Int64(); err == nil && aid > 0 {
+			return nil, errors.Errorf("legacy vmess of outbound %s with alterId %d is not supported by v2ray v5, only vmess aead (alterId 0) is",
+				outbound.Tag, aid)
+		}
+		if user.Flow != "" {
+			return nil, errors.Errorf("flow of outbound %s is not supported by v2ray v5", outbound.Tag)
+		}
+		out.Settings["address"], out.Settings["port"], out.Settings["uuid"] = vnext.Address, port, user.Id
+	default:
+		return nil, errors.Errorf("protocol %s is not supported by jsonv5 rendering", outbound.Protocol)
+	}
+	if outbound.StreamSettings != nil {
+		ss, err := v5StreamOf(outbound.StreamSettings)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "outbound %s", outbound.Tag)
+		}
+		out.StreamSettings = ss
+	}
+	return out, nil
+}
+
+func v5StreamOf(ss *vc.StreamSettings) (*v5StreamSettings, error) {
+	v5 := &v5StreamSettings{}
+	switch ss.Network {
+	case "", "tcp":
+		if ss.TcpSettings != nil && ss.TcpSettings.Header != nil && ss.TcpSettings.Header.Type == "http" {
+			return nil, errors.Errorf("http header obfuscation is not supported by jsonv5 rendering")
+		}
+	case "ws":
+		v5.Transport, v5.TransportSettings = "ws", map[string]any{}
+		if ws := ss.WsSettings; ws != nil {
+			v5.TransportSettings["path"] = ws.Path
+			if host, ok := ws.Headers["Host"].(string); ok && host != "" {
+				v5.TransportSettings["header"] = []map[string]string{{"key": "Host", "value": host}}
+			}
+		}
+	case "http", "h2":
+		v5.Transport, v5.TransportSettings = "h2", map[string]any{}
+		if h := ss.HttpSettings; h != nil {
+			v5.TransportSettings["path"] = h.Path
+			var hosts []string
+			for _, host := range h.Host {
+				if host != "" {
+					hosts = append(hosts, host)
+				}
+			}
+			if len(hosts) > 0 {
+				v5.TransportSettings["host"] = hosts
+			}
+		}
+	case "grpc":
+		v5.Transport, v5.TransportSettings = "grpc", map[string]any{}
+		if ss.GrpcSettings != nil {
+			v5.TransportSettings["serviceName"] = ss.GrpcSettings.ServiceName
+		}
+	default:
+		return nil, errors.Errorf("network %s is not supported by jsonv5 rendering", ss.Network)
+	}
+	switch ss.Security {
+	case "", "none":
+	case "tls":
+		v5.Security, v5.SecuritySettings = "tls", map[string]any{}
+		if t := ss.TlsSettings; t != nil {
+			if t.ServerName != "" {
+				v5.SecuritySettings["serverName"] = t.ServerName
+			}
+			if t.AllowInsecure {
+				v5.SecuritySettings["allowInsecure"] = true
+			}
+			if len(t.Alpn) > 0 {
+				v5.SecuritySettings["nextProtocol"] = t.Alpn
+			}
+		}
+	default:
+		return nil, errors.Errorf("security %s is not supported by v2ray v5", ss.Security)
+	}
+	return v5, nil
+}
+
+func v5RuleOf(rule *vc.Rule) (*v5Rule, error) {
+	r := &v5Rule{
+		Tag:          rule.OutboundTag,
+		BalancingTag: rule.BalancerTag,
+		Networks:     rule.Network,
+		UserEmail:    rule.User,
+		InboundTag:   rule.InboundTag,
+		Protocol:     rule.Protocol,
+		Attributes:   rule.Attrs,
+	}
+	if rule.SourcePort != nil {
+		return nil, errors.Errorf("source port of rule to %s is not supported by jsonv5 rendering", r.Tag+r.BalancingTag)
+	}
+	if rule.Port != nil {
+		r.PortList = fmt.Sprint(rule.Port)
+	}
+	for _, domain := range rule.Domains {
+		kind, value, found := strings.Cut(domain, ":")
+		switch {
+		case !found:
+			r.Domain = append(r.Domain, &v5Domain{Type: "Plain", Value: domain})
+		case kind == "domain":
+			r.Domain = append(r.Domain, &v5Domain{Type: "RootDomain", Value: value})
+		case kind == "full":
+			r.Domain = append(r.Domain, &v5Domain{Type: "Full", Value: value})
+		case kind == "keyword":
+			r.Domain = append(r.Domain, &v5Domain{Type: "Plain", Value: value})
+		case kind == "regexp":
+			r.Domain = append(r.Domain, &v5Domain{Type: "Regex", Value: value})
+		case kind == "geosite":
+			r.GeoDomain = append(r.GeoDomain, &v5GeoDomain{Code: value})
+		default:
+			return nil, errors.Errorf("domain %s is not supported by jsonv5 rendering", domain)
+		}
+	}
+	var err error
+	if r.Geoip, err = v5GeoIPOf(rule.IP); err != nil {
+		return nil, err
+	}
+	if r.SourceGeoip, err = v5GeoIPOf(rule.Source); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func v5GeoIPOf(ips []string) ([]*v5GeoIP, error) {
+	var (
+		geoips []*v5GeoIP
+		cidrs  []*v5Cidr
+	)
+	for _, ip := range ips {
+		if strings.HasPrefix(ip, "geoip:") {
+			geoips = append(geoips, &v5GeoIP{Code: strings.TrimPrefix(ip, "geoip:")})
+			continue
+		}
+		addr, prefix, found := strings.Cut(ip, "/")
+		parsed := net.ParseIP(addr)
+		if parsed == nil {
+			return nil, errors.Errorf("ip %s is not supported by jsonv5 rendering", ip)
+		}
+		bits := 128
+		if parsed.To4() != nil {
+			bits = 32
+		}
+		if found {
+			var err error
+			if bits, err = strconv.Atoi(prefix); err != nil {
+				return nil, errors.Errorf("invalid cidr %s", ip)
+			}
+		}
+		cidrs = append(cidrs, &v5Cidr{IpAddr: addr, Prefix: bits})
+	}
+	if len(cidrs) > 0 {
+		geoips = append(geoips, &v5GeoIP{Cidr: cidrs})
+	}
+	return geoips, nil
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"vc/vc"
+)
+
+func TestV5DnsOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers string
+		want    []*v5Endpoint
+		wantErr bool
+	}{
+		{
+			name:    "ip",
+			servers: `["1.1.1.1", {"address": "8.8.8.8", "port": 5353}]`,
+			want:    []*v5Endpoint{{Address: "1.1.1.1", Port: 53}, {Address: "8.8.8.8", Port: 5353}},
+		},
+		{
+			name:    "urls",
+			servers: `["https://dns.google/dns-query", "https+local://1.1.1.1/dns-query", "tcp://8.8.8.8:53", "quic+local://dns.adguard.com"]`,
+			want: []*v5Endpoint{
+				{Address: "https://dns.google/dns-query"},
+				{Address: "https+local://1.1.1.1/dns-query"},
+				{Address: "tcp://8.8.8.8:53"},
+				{Address: "quic+local://dns.adguard.com"},
+			},
+		},
+		{
+			name:    "local",
+			servers: `["localhost", "fakedns"]`,
+			want:    []*v5Endpoint{{Address: "localhost"}, {Address: "fakedns"}},
+		},
+		{
+			name:    "domain",
+			servers: `["dns.google"]`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown scheme",
+			servers: `["udp://8.8.8.8:53"]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dns := &vc.Dns{}
+			if err := json.Unmarshal([]byte(`{"servers": `+tt.servers+`}`), dns); err != nil {
+				t.Fatal(err)
+			}
+			got, err := v5DnsOf(dns)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("v5DnsOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var endpoints []*v5Endpoint
+			for _, server := range got.NameServer {
+				endpoints = append(endpoints, server.Address)
+			}
+			if !reflect.DeepEqual(endpoints, tt.want) {
+				t.Errorf("v5DnsOf() = %+v, want %+v", endpoints, tt.want)
+			}
+		})
+	}
+}
+
+func TestV5Supports(t *testing.T) {
+	tests := []struct {
+		name     string
+		outbound string
+		wantErr  string
+	}{
+		{
+			name:     "vmess aead",
+			outbound: `{"tag": "a", "protocol": "vmess", "settings": {"vnext": [{"address": "a.example.com", "port": 443, "users": [{"id": "uuid", "alterId": 0}]}]}}`,
+		},
+		{
+			name:     "legacy vmess",
+			outbound: `{"tag": "a", "protocol": "vmess", "settings": {"vnext": [{"address": "a.example.com", "port": 443, "users": [{"id": "uuid", "alterId": 64}]}]}}`,
+			wantErr:  "legacy vmess",
+		},
+		{
+			name:     "vless with flow",
+			outbound: `{"tag": "a", "protocol": "vless", "settings": {"vnext": [{"address": "a.example.com", "port": 443, "users": [{"id": "uuid", "flow": "xtls-rprx-vision"}]}]}}`,
+			wantErr:  "flow",
+		},
+		{
+			name:     "reality",
+			outbound: `{"tag": "a", "protocol": "trojan", "settings": {"servers": [{"address": "a.example.com", "port": 443, "password": "p"}]}, "streamSettings": {"security": "reality"}}`,
+			wantErr:  "security reality",
+		},
+	}
+	driver, _ := Get(V2ray5)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbound := &vc.Outbound{}
+			if err := json.Unmarshal([]byte(tt.outbound), outbound); err != nil {
+				t.Fatal(err)
+			}
+			err := driver.Supports(outbound)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Supports() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
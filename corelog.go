@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var coreLogTail = 1000
+
+func init() {
+	if s := os.Getenv("VC_CORE_LOG_TAIL"); s != "" {
+		if i, err := strconv.Atoi(s); err != nil || i < 1 {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_CORE_LOG_TAIL=%s", s))
+		} else {
+			coreLogTail = i
+		}
+	}
+}
+
+var (
+	logLinePattern = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)? \[(\w+)] (?:\[\d+] )?(?:([\w./-]+): )?(.*)$`)
+	// sing-box logs like "+0800 2023-02-20 10:00:00 INFO [1234 0ms] router: message"
+	sbLogLinePattern  = regexp.MustCompile(`^(?:[+-]\d{4} \d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} )?(TRACE|DEBUG|INFO|WARN|ERROR|FATAL|PANIC)(?:\[\d+])? (?:\[[^]]*] )?(?:([\w./-]+(?:\[[^]]*])?): )?(.*)$`)
+	accessLinePattern = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)? (?:from )?(\S+) (accepted|rejected) (\S+)(?: \[([^]]*)])?(?: (.*))?$`)
+	// fatalLinePattern matches the error v2ray and xray print when they fail
+	// to start, that restarting with the same config does not fix, like
+	// "Failed to start: main: failed to load config files: ..." of xray and
+	// v2ray 5, or "main: failed to read config files: ..." of v2ray 4.
+	// sing-box reports it at the FATAL level.
+	fatalLinePattern = regexp.MustCompile(`(?i)^(?:failed to start: |(?:[\w.-]+/)*main: failed to )`)
+)
+
+type AccessEntry struct {
+	From   string `json:"from"`
+	Status string `json:"status"`
+	To     string `json:"to"`
+	Route  string `json:"route,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type LogEntry struct {
+	At        time.Time    `json:"at"`
+	Pid       int          `json:"pid"`
+	Level     string       `json:"level"`
+	Component string       `json:"component,omitempty"`
+	Message   string       `json:"message"`
+	Fatal     bool         `json:"fatal,omitempty"`
+	Access    *AccessEntry `json:"access,omitempty"`
+}
+
+// parseLogLine parses a line of core output, either an error log, an access
+// log, or anything else the core prints, such as its banner.
+func parseLogLine(line string) LogEntry {
+	if m := logLinePattern.FindStringSubmatch(line); m != nil {
+		return LogEntry{Level: strings.ToLower(m[1]), Component: m[2], Message: m[3]}
+	}
+	if m := accessLinePattern.FindStringSubmatch(line); m != nil {
+		return LogEntry{
+			Level:   "info",
+			Message: "access",
+			Access:  &AccessEntry{From: m[1], Status: m[2], To: m[3], Route: m[4], Detail: m[5]},
+		}
+	}
+	if m := sbLogLinePattern.FindStringSubmatch(line); m != nil {
+		e := LogEntry{Level: strings.ToLower(m[1]), Component: m[2], Message: m[3]}
+		switch e.Level {
+		case "trace":
+			e.Level = "debug"
+		case "warn":
+			e.Level = "warning"
+		case "fatal", "panic":
+			e.Level, e.Fatal = "error", true
+		}
+		return e
+	}
+	e := LogEntry{Level: "info", Message: line}
+	if fatalLinePattern.MatchString(line) {
+		e.Level, e.Fatal = "error", true
+	}
+	return e
+}
+
+func logLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// logTail keeps the latest coreLogTail log entries of every core instance.
+type logTail struct {
+	mux     sync.Mutex
+	entries []LogEntry
+	start   int
+}
+
+var coreLogs = &logTail{}
+
+func (t *logTail) add(e LogEntry) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if len(t.entries) < coreLogTail {
+		t.entries = append(t.entries, e)
+		return
+	}
+	t.entries[t.start] = e
+	t.start = (t.start + 1) % len(t.entries)
+}
+
+// List returns up to n latest entries at level or above, oldest first.
+func (t *logTail) List(n int, level string) []LogEntry {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	min := logLevel(level)
+	entries := make([]LogEntry, 0, len(t.entries))
+	for i := range t.entries {
+		e := t.entries[(t.start+i)%len(t.entries)]
+		if level == "" || logLevel(e.Level) >= min {
+			entries = append(entries, e)
+		}
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries
+}
+
+// coreLog receives the output of a core process line by line, logs it as
+// structured records, keeps it in the tail, and remembers the first fatal
+// error.
+type coreLog struct {
+	mux   sync.Mutex
+	pid   int
+	buf   []byte
+	fatal string
+}
+
+func (l *coreLog) started(pid int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.pid = pid
+}
+
+func (l *coreLog) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(l.buf[:i]), "\r")
+		l.buf = l.buf[i+1:]
+		if line != "" {
+			l.line(line)
+		}
+	}
+	return len(p), nil
+}
+
+func (l *coreLog) line(line string) {
+	e := parseLogLine(line)
+	e.At, e.Pid = time.Now(), l.pid
+	coreLogs.add(e)
+	if e.Access != nil {
+		slog.Debug("core access", "core", e.Pid, "from", e.Access.From, "status", e.Access.Status,
+			"to", e.Access.To, "route", e.Access.Route)
+		return
+	}
+	if l.fatal == "" && e.Fatal {
+		l.fatal = e.Message
+		events.publish(EventConfigInvalid, map[string]any{"pid": e.Pid, "error": e.Message})
+	}
+	args := []any{"core", e.Pid}
+	if e.Component != "" {
+		args = append(args, "component", e.Component)
+	}
+	slog.Log(logLevel(e.Level), e.Message, args...)
+}
+
+// Fatal returns the fatal error the core reported, if any.
+func (l *coreLog) Fatal() string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.fatal
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want LogEntry
+	}{
+		{
+			name: "xray error log",
+			line: "2023/02/20 10:00:00.123456 [Warning] [1234567] app/dispatcher: default route for tcp:example.com:443",
+			want: LogEntry{Level: "warning", Component: "app/dispatcher", Message: "default route for tcp:example.com:443"},
+		},
+		{
+			name: "v2ray error log without session",
+			line: "2023/02/20 10:00:00 [Info] transport/internet/websocket: creating connection to ws://a.example.com/",
+			want: LogEntry{Level: "info", Component: "transport/internet/websocket", Message: "creating connection to ws://a.example.com/"},
+		},
+		{
+			name: "access log",
+			line: "2023/02/20 10:00:00.123456 from 127.0.0.1:50000 accepted tcp:example.com:443 [socks >> proxy] email: a@example.com",
+			want: LogEntry{Level: "info", Message: "access", Access: &AccessEntry{
+				From: "127.0.0.1:50000", Status: "accepted", To: "tcp:example.com:443", Route: "socks >> proxy", Detail: "email: a@example.com",
+			}},
+		},
+		{
+			name: "rejected access",
+			line: "2023/02/20 10:00:00 127.0.0.1:50000 rejected tcp:example.com:443",
+			want: LogEntry{Level: "info", Message: "access", Access: &AccessEntry{From: "127.0.0.1:50000", Status: "rejected", To: "tcp:example.com:443"}},
+		},
+		{
+			name: "sing-box log",
+			line: "+0800 2023-02-20 10:00:00 WARN [1234 0ms] router: rule set is empty",
+			want: LogEntry{Level: "warning", Component: "router", Message: "rule set is empty"},
+		},
+		{
+			name: "sing-box fatal",
+			line: "FATAL[0000] start service: initialize inbound[0]: listen tcp :1080: bind: address already in use",
+			want: LogEntry{Level: "error", Fatal: true, Message: "start service: initialize inbound[0]: listen tcp :1080: bind: address already in use"},
+		},
+		{
+			name: "xray failed to start",
+			line: "Failed to start: main: failed to load config files: [config.json] > infra/conf: unknown field",
+			want: LogEntry{Level: "error", Fatal: true, Message: "Failed to start: main: failed to load config files: [config.json] > infra/conf: unknown field"},
+		},
+		{
+			name: "banner",
+			line: "Xray 1.8.0 (Xray, Penetrates Everything.) Custom (go1.20 linux/amd64)",
+			want: LogEntry{Level: "info", Message: "Xray 1.8.0 (Xray, Penetrates Everything.) Custom (go1.20 linux/amd64)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLogLine(tt.line); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLogLine() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
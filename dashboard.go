@@ -0,0 +1,34 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+//go:embed web
+var webFS embed.FS
+
+// dashboard serves the single page dashboard, which drives the API from the
+// browser.
+func dashboard() http.Handler {
+	web, err := fs.Sub(webFS, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(web))
+}
+
+// dashboardFile tells whether path is a static file of the dashboard.
+func dashboardFile(path string) bool {
+	if path == "/" {
+		return true
+	}
+	name := strings.TrimPrefix(path, "/")
+	if !fs.ValidPath(name) {
+		return false
+	}
+	info, err := fs.Stat(webFS, "web/"+name)
+	return err == nil && !info.IsDir()
+}
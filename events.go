@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vc/sub/check"
+	"vc/vc"
+)
+
+const (
+	EventSubFetched      = "sub.fetched"
+	EventSubChanged      = "sub.changed"
+	EventEndpointHealth  = "endpoint.health"
+	EventBalancerChanged = "balancer.changed"
+	EventCoreStarted     = "core.started"
+	EventCoreReady       = "core.ready"
+	EventCoreExited      = "core.exited"
+	EventCoreRestarted   = "core.restarted"
+	EventConfigInvalid   = "config.invalid"
+)
+
+var (
+	eventBacklog   = 100
+	eventHeartbeat = 15 * time.Second
+)
+
+type Event struct {
+	Id   uint64    `json:"id"`
+	At   time.Time `json:"at"`
+	Type string    `json:"type"`
+	Data any       `json:"data,omitempty"`
+}
+
+// eventBus fans events out to the subscribers, and keeps the latest ones for
+// subscribers resuming with Last-Event-ID.
+type eventBus struct {
+	mux    sync.Mutex
+	seq    uint64
+	recent []Event
+	subs   map[chan Event]struct{}
+}
+
+var events = &eventBus{subs: map[chan Event]struct{}{}}
+
+// publish never blocks, a subscriber too slow to keep up misses events.
+func (b *eventBus) publish(typ string, data any) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.seq++
+	e := Event{Id: b.seq, At: time.Now(), Type: typ, Data: data}
+	b.recent = append(b.recent, e)
+	if len(b.recent) > eventBacklog {
+		b.recent = b.recent[len(b.recent)-eventBacklog:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns the events after lastId still kept, and a channel of the
+// events to come.
+func (b *eventBus) subscribe(lastId uint64) ([]Event, chan Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	var missed []Event
+	if lastId > 0 {
+		for _, e := range b.recent {
+			if e.Id > lastId {
+				missed = append(missed, e)
+			}
+		}
+	}
+	ch := make(chan Event, 64)
+	b.subs[ch] = struct{}{}
+	return missed, ch
+}
+
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.subs, ch)
+}
+
+// handleEvents streams events as server-sent events, optionally only the
+// types prefixed by one of the comma separated ?types=.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	var types []string
+	if s := r.URL.Query().Get("types"); s != "" {
+		types = strings.Split(s, ",")
+	}
+	lastId, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	missed, ch := events.subscribe(lastId)
+	defer events.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		writeEvent(w, e, types)
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			writeEvent(w, e, types)
+		case <-heartbeat.C:
+			_, _ = fmt.Fprint(w, ": ping\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e Event, types []string) {
+	if len(types) > 0 {
+		matched := false
+		for _, t := range types {
+			if strings.HasPrefix(e.Type, strings.TrimSpace(t)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+}
+
+var (
+	healthMux  = &sync.Mutex{}
+	lastHealth = map[string]bool{}
+)
+
+// publishHealth publishes the endpoints whose health changed since the
+// previous check.
+func publishHealth(reports []check.Report) {
+	healthMux.Lock()
+	defer healthMux.Unlock()
+	current := make(map[string]bool, len(reports))
+	for _, r := range reports {
+		current[r.Tag] = r.Healthy
+		prev, found := lastHealth[r.Tag]
+		if found && prev == r.Healthy {
+			continue
+		}
+		from := "unchecked"
+		if found {
+			from = healthName(prev)
+		}
+		events.publish(EventEndpointHealth, map[string]any{
+			"tag": r.Tag, "from": from, "to": healthName(r.Healthy),
+		})
+	}
+	lastHealth = current
+}
+
+func healthName(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
+
+// publishBalancers publishes the balancers whose selected endpoints changed
+// from oldCfg to newCfg.
+func publishBalancers(oldCfg *vc.Config, newCfg *vc.Config) {
+	selectors := func(cfg *vc.Config) map[string][]string {
+		m := map[string][]string{}
+		if cfg != nil && cfg.Routing != nil {
+			for _, b := range cfg.Routing.Balancers {
+				m[b.Tag] = b.Selector
+			}
+		}
+		return m
+	}
+	olds, news := selectors(oldCfg), selectors(newCfg)
+	for tag, selector := range news {
+		if reflect.DeepEqual(olds[tag], selector) {
+			continue
+		}
+		events.publish(EventBalancerChanged, map[string]any{
+			"balancer": tag,
+			"added":    difference(selector, olds[tag]),
+			"removed":  difference(olds[tag], selector),
+			"selector": selector,
+		})
+	}
+}
+
+// difference returns the tags of a not in b.
+func difference(a []string, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, tag := range b {
+		in[tag] = true
+	}
+	diff := []string{}
+	for _, tag := range a {
+		if !in[tag] {
+			diff = append(diff, tag)
+		}
+	}
+	return diff
+}
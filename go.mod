@@ -1,6 +1,6 @@
 module vc
 
-go 1.19
+go 1.24
 
 require (
 	github.com/pkg/errors v0.9.1
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"vc/core"
+	"vc/vc"
+)
+
+const (
+	coreApiTag       = "vc-api"
+	handlerService   = "HandlerService"
+	testOutPrefix    = "test-out-"
+	defaultOutPrefix = "default-out-"
+)
+
+// hotUpdate applies outbound changes through the API of the core instead of
+// restarting it. It needs core.FeatureApi, which only Xray has: with any other
+// core, including the default v2ray 4, every change restarts the core.
+var (
+	hotUpdate   = false
+	coreApiPort = 10085
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_HOT_UPDATE"); ok && (s == "true" || s == "on") {
+		slog.Info("hot update of outbounds enabled")
+		hotUpdate = true
+	}
+	if s := os.Getenv("VC_CORE_API_PORT"); s != "" {
+		if p, err := strconv.ParseInt(s, 10, 32); err != nil {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_CORE_API_PORT=%s", s))
+		} else {
+			coreApiPort = int(p)
+		}
+	}
+}
+
+var (
+	coreMux    = &sync.Mutex{}
+	runningCfg *vc.Config
+)
+
+// materialize turns the serving config into what is written for the core.
+// With hot update enabled, balancer membership is expressed by the presence
+// of endpoint outbounds instead of balancer selectors, which cannot be
+// changed at runtime: the RoutingService of the API only pins a balancer to
+// one of its outbounds. The first balancer selects every endpoint, and
+// outbounds of endpoints out of balance are left out, to be added and removed
+// through the HandlerService. The default outbound, the first endpoint, is
+// served by a copy of it that stays whatever its health.
+// With traffic stats enabled, the counters are turned on.
+// Either way test inbounds are routed to copies of the endpoint outbounds, so
+// that endpoints out of balance are still checked and checks are not counted
+// as endpoint traffic, and the API is exposed on a local inbound.
+func materialize(cfg *vc.Config) (*vc.Config, error) {
+	hot := hotUpdate && coreDriver.Has(core.FeatureApi)
+	stats := trafficStats && coreDriver.Has(core.FeatureStats)
+	if !hot && !stats {
+		return cfg, nil
+	}
+	for _, inbound := range cfg.Inbounds {
+		if portTaken(inbound, coreApiPort) {
+			return nil, errors.Errorf("core api port %d is taken by inbound %q, change VC_CORE_API_PORT", coreApiPort, inbound.Tag)
+		}
+	}
+	cfg, err := vc.DeepClone(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Routing == nil {
+		cfg.Routing = &vc.Routing{}
+	}
+	epTags := testOutbounds(cfg)
+	var services []string
+	if hot {
+		if err := hotOutbounds(cfg, epTags); err != nil {
+			slog.Info(fmt.Sprintf("hot update unavailable, changes restart the core: %v", err))
+		} else {
+			services = append(services, handlerService)
+		}
+	}
+	if stats {
+		enableStats(cfg)
+		services = append(services, "StatsService")
+	}
+	if len(services) == 0 {
+		return cfg, nil
+	}
+	// the services are added to those the config may expose itself
+	if cfg.Api == nil {
+		cfg.Api = &vc.Api{Tag: coreApiTag}
+	}
+	for _, service := range services {
+		if !hasService(cfg.Api, service) {
+			cfg.Api.Services = append(cfg.Api.Services, service)
+		}
+	}
+	cfg.Inbounds = append(cfg.Inbounds, &vc.Inbound{
+		Listen:   "127.0.0.1",
+		Port:     coreApiPort,
+		Protocol: "dokodemo-door",
+		Settings: &vc.InboundCommonSettings{Address: "127.0.0.1"},
+		Tag:      coreApiTag,
+	})
+	cfg.Routing.Rules = append([]*vc.Rule{{
+		Type:        "field",
+		InboundTag:  []string{coreApiTag},
+		OutboundTag: cfg.Api.Tag,
+	}}, cfg.Routing.Rules...)
+	return cfg, nil
+}
+
+func hasService(api *vc.Api, service string) bool {
+	if api == nil {
+		return false
+	}
+	for _, s := range api.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// portTaken reports whether an inbound listens on port, given as a number, or
+// a string of numbers and ranges like "1000-2000,3000".
+func portTaken(inbound *vc.Inbound, port int) bool {
+	if p, ok := inboundPort(inbound); ok {
+		return p == port
+	}
+	s, ok := inbound.Port.(string)
+	if !ok {
+		return false
+	}
+	for _, r := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(r, "-")
+		low, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			continue
+		}
+		high := low
+		if isRange {
+			if high, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+				continue
+			}
+		}
+		if low <= port && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// testOutbounds routes the test inbounds to copies of the endpoint outbounds,
+// and returns the tags of the endpoints.
+func testOutbounds(cfg *vc.Config) map[string]bool {
+	epTags := map[string]bool{}
+	for _, rule := range cfg.Routing.Rules {
+		if len(rule.InboundTag) != 1 || !strings.HasPrefix(rule.InboundTag[0], "test-in-") || rule.OutboundTag == "" {
+			continue
+		}
+		epTags[rule.OutboundTag] = true
+		rule.OutboundTag = testOutPrefix + rule.OutboundTag
+	}
+	var copies []*vc.Outbound
+	for _, outbound := range cfg.Outbounds {
+		if epTags[outbound.Tag] {
+			c := *outbound
+			c.Tag = testOutPrefix + outbound.Tag
+			copies = append(copies, &c)
+		}
+	}
+	cfg.Outbounds = append(cfg.Outbounds, copies...)
+	return epTags
+}
+
+// hotOutbounds moves balancer membership from selectors to the presence of
+// endpoint outbounds. The presence of an outbound cannot tell balancers
+// apart, so it fails if balancers other than the first select endpoints.
+func hotOutbounds(cfg *vc.Config, epTags map[string]bool) error {
+	if len(epTags) == 0 || len(cfg.Routing.Balancers) == 0 {
+		return nil
+	}
+	for _, b := range cfg.Routing.Balancers[1:] {
+		for _, tag := range b.Selector {
+			if epTags[tag] {
+				return errors.Errorf("balancer %s selects endpoint %s beside balancer %s", b.Tag, tag, cfg.Routing.Balancers[0].Tag)
+			}
+		}
+	}
+	// the default outbound cannot be changed in place, so it must not come and
+	// go with the health of the first endpoint
+	if first := cfg.Outbounds[0]; epTags[first.Tag] {
+		c := *first
+		c.Tag = defaultOutPrefix + first.Tag
+		cfg.Outbounds = append([]*vc.Outbound{&c}, cfg.Outbounds...)
+	}
+	members := map[string]bool{}
+	for _, tag := range cfg.Routing.Balancers[0].Selector {
+		members[tag] = true
+	}
+	outbounds := make([]*vc.Outbound, 0, len(cfg.Outbounds))
+	for _, outbound := range cfg.Outbounds {
+		if !epTags[outbound.Tag] || members[outbound.Tag] {
+			outbounds = append(outbounds, outbound)
+		}
+	}
+	cfg.Outbounds = outbounds
+	selector := make([]string, 0, len(epTags))
+	for tag := range epTags {
+		selector = append(selector, tag)
+	}
+	sort.Strings(selector)
+	for _, tag := range cfg.Routing.Balancers[0].Selector {
+		if !epTags[tag] {
+			selector = append(selector, tag)
+		}
+	}
+	cfg.Routing.Balancers[0].Selector = selector
+	return nil
+}
+
+func loadConfigFile(filename string) (*vc.Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file failed")
+	}
+	cfg := &vc.Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, errors.Wrap(err, "decoding config file failed")
+	}
+	return cfg, nil
+}
+
+func writeConfig(filename string, cfg *vc.Config) error {
+	cfg, err := materialize(cfg)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return errors.Wrap(err, "marshalling config failed")
+	}
+	return errors.Wrap(os.WriteFile(filename, data, 0644), "writing config file failed")
+}
+
+// renderCoreConfig renders the config file in the format of the core, and
+// returns the file to run the core with.
+func renderCoreConfig(filename string) (string, error) {
+	cfg, err := loadConfigFile(filename)
+	if err != nil {
+		return "", err
+	}
+	data, err := coreDriver.Render(cfg)
+	if err != nil {
+		err = errors.Wrapf(err, "rendering config for %s failed", coreDriver.Name())
+		events.publish(EventConfigInvalid, map[string]any{"error": err.Error()})
+		return "", err
+	}
+	ext := filepath.Ext(filename)
+	coreFile := fmt.Sprintf("%s.%s%s", strings.TrimSuffix(filename, ext), coreDriver.Name(), ext)
+	if err := os.WriteFile(coreFile, data, 0644); err != nil {
+		return "", errors.Wrap(err, "writing core config file failed")
+	}
+	return coreFile, nil
+}
+
+// coreStarted records the config the core is started with, for later diffs.
+func coreStarted(filename string) {
+	coreMux.Lock()
+	defer coreMux.Unlock()
+	runningCfg = nil
+	cfg, err := loadConfigFile(filename)
+	if err != nil {
+		slog.Warn("loading running config failed", slog.ErrorKey, err)
+		return
+	}
+	runningCfg = cfg
+}
+
+// applyChange brings the core up to date with the config file, in place when
+// possible, or by restarting it. It reports whether the core is restarted.
+func applyChange(ctx context.Context, filename string, restart chan<- struct{}) bool {
+	if hotUpdate && coreDriver.Has(core.FeatureApi) {
+		err := hotApply(ctx, filename)
+		if err == nil {
+			slog.Info("config change applied to running core")
+			return false
+		}
+		slog.Info(fmt.Sprintf("cannot apply change in place: %+v", err))
+	}
+	slog.Info("restart core...")
+	restart <- struct{}{}
+	return true
+}
+
+func hotApply(ctx context.Context, filename string) error {
+	coreMux.Lock()
+	defer coreMux.Unlock()
+	if runningCfg == nil {
+		return errors.Errorf("running config unknown")
+	}
+	if !hasService(runningCfg.Api, handlerService) {
+		return errors.Errorf("running core has no %s", handlerService)
+	}
+	newCfg, err := loadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	removes, adds, err := diffOutbounds(runningCfg, newCfg)
+	if err != nil {
+		return err
+	}
+	// the running config is unknown once a call has been made, whatever its result
+	runningCfg = nil
+	server, service := fmt.Sprintf("127.0.0.1:%d", coreApiPort), coreDriver.HandlerService()
+	for _, tag := range removes {
+		if err := core.RemoveOutbound(ctx, server, service, tag); err != nil {
+			return errors.Wrapf(err, "removing outbound %s failed", tag)
+		}
+	}
+	for _, outbound := range adds {
+		if err := core.AddOutbound(ctx, server, service, outbound); err != nil {
+			return errors.Wrapf(err, "adding outbound %s failed", outbound.Tag)
+		}
+	}
+	runningCfg = newCfg
+	slog.Info(fmt.Sprintf("%d outbounds removed, %d outbounds added", len(removes), len(adds)))
+	return nil
+}
+
+// diffOutbounds returns the outbounds to remove and add to get from old to
+// new, or an error if anything else differs.
+func diffOutbounds(old, new *vc.Config) ([]string, []*vc.Outbound, error) {
+	if len(old.Outbounds) == 0 || len(new.Outbounds) == 0 {
+		return nil, nil, errors.Errorf("no outbounds")
+	}
+	if !jsonEqual(old.Outbounds[0], new.Outbounds[0]) {
+		return nil, nil, errors.Errorf("default outbound changed")
+	}
+	oldRest, newRest := *old, *new
+	oldRest.Outbounds, newRest.Outbounds = nil, nil
+	if !jsonEqual(&oldRest, &newRest) {
+		return nil, nil, errors.Errorf("sections other than outbounds changed")
+	}
+	oldOutbounds := make(map[string]*vc.Outbound, len(old.Outbounds))
+	for _, outbound := range old.Outbounds {
+		oldOutbounds[outbound.Tag] = outbound
+	}
+	var (
+		removes []string
+		adds    []*vc.Outbound
+	)
+	newTags := make(map[string]bool, len(new.Outbounds))
+	for _, outbound := range new.Outbounds {
+		newTags[outbound.Tag] = true
+		oldOutbound, found := oldOutbounds[outbound.Tag]
+		if found && jsonEqual(oldOutbound, outbound) {
+			continue
+		}
+		if found {
+			removes = append(removes, outbound.Tag)
+		}
+		adds = append(adds, outbound)
+	}
+	for _, outbound := range old.Outbounds {
+		if !newTags[outbound.Tag] {
+			removes = append(removes, outbound.Tag)
+		}
+	}
+	return removes, adds, nil
+}
+
+func jsonEqual(a, b any) bool {
+	aData, aErr := json.Marshal(a)
+	bData, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aData, bData)
+}
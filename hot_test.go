@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"vc/core"
+	"vc/vc"
+)
+
+// hotConfig returns a config with endpoints a and b under test inbounds, and
+// balancer main selecting a.
+func hotConfig() *vc.Config {
+	return &vc.Config{
+		Api:      &vc.Api{Tag: "api", Services: []string{"LoggerService"}},
+		Inbounds: []*vc.Inbound{{Tag: "in", Port: 1080}, {Tag: "test-in-a", Port: 20001}, {Tag: "test-in-b", Port: 20002}},
+		Outbounds: []*vc.Outbound{
+			{Tag: "a", Protocol: "vless"},
+			{Tag: "b", Protocol: "vless"},
+			{Tag: "direct", Protocol: "freedom"},
+		},
+		Routing: &vc.Routing{
+			Rules: []*vc.Rule{
+				{Type: "field", InboundTag: []string{"test-in-a"}, OutboundTag: "a"},
+				{Type: "field", InboundTag: []string{"test-in-b"}, OutboundTag: "b"},
+			},
+			Balancers: []*vc.Balancer{{Tag: "main", Selector: []string{"a"}}},
+		},
+	}
+}
+
+func outboundTags(cfg *vc.Config) map[string]bool {
+	tags := map[string]bool{}
+	for _, outbound := range cfg.Outbounds {
+		tags[outbound.Tag] = true
+	}
+	return tags
+}
+
+func TestMaterializeHot(t *testing.T) {
+	driver, hot, stats, port := coreDriver, hotUpdate, trafficStats, coreApiPort
+	t.Cleanup(func() {
+		coreDriver, hotUpdate, trafficStats, coreApiPort = driver, hot, stats, port
+	})
+	coreDriver, _ = core.Get(core.Xray)
+	hotUpdate, trafficStats, coreApiPort = true, false, 10085
+
+	cfg, err := materialize(hotConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := outboundTags(cfg)
+	for _, tag := range []string{"default-out-a", "a", "direct", "test-out-a", "test-out-b"} {
+		if !tags[tag] {
+			t.Errorf("outbound %s is missing", tag)
+		}
+	}
+	if tags["b"] {
+		t.Errorf("outbound b out of balance is kept")
+	}
+	if selector := cfg.Routing.Balancers[0].Selector; len(selector) != 2 || selector[0] != "a" || selector[1] != "b" {
+		t.Errorf("main balancer selects %v, want [a b]", selector)
+	}
+	if services := cfg.Api.Services; cfg.Api.Tag != "api" || len(services) != 2 || services[1] != handlerService {
+		t.Errorf("api = %+v, want tag api with LoggerService and %s", cfg.Api, handlerService)
+	}
+	if rule := cfg.Routing.Rules[0]; rule.InboundTag[0] != coreApiTag || rule.OutboundTag != "api" {
+		t.Errorf("first rule routes %v to %s, want %s to api", rule.InboundTag, rule.OutboundTag, coreApiTag)
+	}
+
+	// an endpoint selected by another balancer leaves the selectors alone
+	country := hotConfig()
+	country.Routing.Balancers = append(country.Routing.Balancers, &vc.Balancer{Tag: "country-US", Selector: []string{"b"}})
+	cfg, err = materialize(country)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := outboundTags(cfg); !tags["b"] || tags["default-out-a"] {
+		t.Errorf("outbounds = %v, want the endpoints as they are", tags)
+	}
+	if selector := cfg.Routing.Balancers[0].Selector; len(selector) != 1 || selector[0] != "a" {
+		t.Errorf("main balancer selects %v, want [a]", selector)
+	}
+	if hasService(cfg.Api, handlerService) {
+		t.Errorf("%s is exposed without hot update", handlerService)
+	}
+
+	clash := hotConfig()
+	clash.Inbounds[0].Port = "10000-10100"
+	if _, err := materialize(clash); err == nil {
+		t.Errorf("materialize() with the api port taken succeeded")
+	}
+}
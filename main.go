@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
 	"golang.org/x/exp/slog"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
@@ -17,7 +19,7 @@ import (
 	"sync/atomic"
 	"syscall"
 	"time"
-	"unsafe"
+	"vc/core"
 	"vc/sub"
 	"vc/sub/check"
 	"vc/vc"
@@ -31,6 +33,10 @@ var (
 	v2rayBin    = "/opt/v2ray/v2ray"
 	subPeriod   = time.Minute
 	apiPort     = 0
+	enableGeoIP = false
+	geoIPFile   = ""
+	stateDir    = "state"
+	coreDriver  core.Driver
 )
 
 func init() {
@@ -62,6 +68,26 @@ func init() {
 		slog.Info(fmt.Sprintf("use v2ray bin from environment: %s", s))
 		v2rayBin = s
 	}
+	coreDriver, _ = core.Get(core.V2ray4)
+	if s := os.Getenv("VC_CORE"); s != "" {
+		if d, err := core.Get(s); err != nil {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_CORE=%s, use %s", s, coreDriver.Name()), slog.ErrorKey, err)
+		} else {
+			slog.Info(fmt.Sprintf("use core from environment: %s", s))
+			coreDriver = d
+		}
+	}
+	if s, ok := os.LookupEnv("VC_GEOIP"); ok && (s == "true" || s == "on") {
+		enableGeoIP = true
+	}
+	if s := os.Getenv("VC_GEOIP_FILE"); s != "" {
+		slog.Info(fmt.Sprintf("use geoip file from environment: %s", s))
+		geoIPFile = s
+	}
+	if s := os.Getenv("VC_STATE_DIR"); s != "" {
+		slog.Info(fmt.Sprintf("use state directory from environment: %s", s))
+		stateDir = s
+	}
 	if s := os.Getenv("VC_API_PORT"); s != "" {
 		if p, err := strconv.ParseInt(s, 10, 32); err != nil {
 			slog.Warn(fmt.Sprintf("invalid environment value: VC_API_PORT=%s", s))
@@ -76,6 +102,7 @@ var (
 	servingCfg *vc.Config
 	lastSubEps []sub.Endpoint
 	checkOkEps []sub.Endpoint
+	allDown    bool
 )
 
 func main() {
@@ -88,122 +115,212 @@ func main() {
 		slog.Error("read v2ray config failed", err)
 		return
 	}
+	if subUrl != "" && enableCheck {
+		if err := check.ValidateFallback(baseCfg); err != nil {
+			slog.Error("invalid all-down policy", err)
+			return
+		}
+	}
+	if trafficStats && !coreDriver.Has(core.FeatureStats) {
+		slog.Warn(fmt.Sprintf("traffic stats are not supported by %s, disabled", coreDriver.Name()))
+		trafficStats = false
+	}
+	if hotUpdate && !coreDriver.Has(core.FeatureApi) {
+		slog.Warn(fmt.Sprintf("hot update is not supported by %s, disabled, changes restart the core", coreDriver.Name()))
+		hotUpdate = false
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		slog.Error("creating state directory failed", err)
+		return
+	}
+	if err := check.LoadHistory(historyFile()); err != nil {
+		slog.Warn("loading check history failed", slog.ErrorKey, err)
+	}
+	if err := check.LoadOverrides(overridesFile()); err != nil {
+		slog.Warn("loading overrides failed", slog.ErrorKey, err)
+	}
+	if err := loadTraffic(trafficFile()); err != nil {
+		slog.Warn("loading traffic stats failed", slog.ErrorKey, err)
+	}
+	if err := loadBaseHistory(baseHistoryFile()); err != nil {
+		slog.Warn("loading base config history failed", slog.ErrorKey, err)
+	}
+	if subUrl != "" {
+		if err := restoreEndpoints(); err != nil {
+			slog.Warn("restoring endpoints failed", slog.ErrorKey, err)
+		}
+	}
 	filename, err := renderConfig()
 	if err != nil {
 		slog.Error("rendering config file failed", err)
 		return
 	}
-	subNotify, checkNotify, restartNotify := make(chan string), make(chan string), make(chan struct{})
+	if enableGeoIP {
+		// geoip.dat of the core, or a MaxMind DB file
+		geoFile := geoIPFile
+		if geoFile == "" {
+			geoFile = filepath.Join(v2rayAsset, "geoip.dat")
+		}
+		if err := check.LoadGeoIP(geoFile); err != nil {
+			slog.Warn(fmt.Sprintf("loading geoip from %s failed, exit country detection disabled", geoFile), slog.ErrorKey, err)
+		}
+	}
+	subTrigger, checkTrigger, restartNotify := newTrigger(), newTrigger(), make(chan struct{})
 	if subUrl != "" {
 		slog.Info("check subscription before starting core...")
-		if changed, err := doSubscribe(filename); err != nil {
-			slog.Warn("checking subscription failed, use base config")
+		if result, err := doSubscribe(filename); err != nil {
+			if len(lastSubEps) > 0 {
+				slog.Warn("checking subscription failed, use endpoints restored from state")
+			} else {
+				slog.Warn("checking subscription failed, use base config")
+			}
 		} else {
-			if changed {
+			if result.Changed {
 				slog.Info("config is modified by subscription")
 			}
 		}
 	}
 	slog.Info("starting core...")
+	coreDone := make(chan struct{})
 	go func() {
+		defer close(coreDone)
+		if blueGreen {
+			runBlueGreenLoop(ctx, filename, restartNotify)
+			return
+		}
 		runCoreLoop(ctx, filename, restartNotify)
 	}()
 	if subUrl != "" {
 		go func() {
 			slog.Info("starting subscription check loop")
-			subLoop(ctx, filename, subNotify, restartNotify)
+			subLoop(ctx, filename, subTrigger, restartNotify)
 		}()
 		if enableCheck {
 			go func() {
 				slog.Info("starting connectivity check loop")
-				checkLoop(ctx, filename, checkNotify, restartNotify)
+				checkLoop(ctx, filename, checkTrigger, restartNotify)
 			}()
+			go historyLoop(ctx)
 		}
 	}
-	if apiPort > 0 {
+	if trafficStats {
+		go func() {
+			slog.Info("starting traffic stats loop")
+			trafficLoop(ctx)
+		}()
+	}
+	if apiPort > 0 || apiSocket != "" {
 		go func() {
-			startApi(ctx, subNotify, checkNotify, restartNotify)
+			startApi(ctx, filename, subTrigger, checkTrigger, restartNotify)
 		}()
 	}
 	select {
 	case <-ctx.Done():
 		slog.Info("stopping...")
 	}
+	<-coreDone
 }
 
-func runCoreLoop(ctx context.Context, filename string, restart chan struct{}) {
-	var cmd *exec.Cmd
-	pup := (*unsafe.Pointer)(unsafe.Pointer(&cmd))
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				break
-			default:
-			}
-			slog.Info("run core...")
-			newCmd := coreCmd(ctx, filename)
-			atomic.StorePointer(pup, unsafe.Pointer(newCmd))
-			if err := newCmd.Run(); err != nil {
-				slog.Error("core running failed", err)
-			} else {
-				slog.Info("core stopped.")
-			}
+func startApi(ctx context.Context, filename string, subTrigger *trigger, checkTrigger *trigger, restartNotify chan struct{}) {
+	throughputRunning := &atomic.Bool{}
+	http.HandleFunc("/api/sub", func(w http.ResponseWriter, r *http.Request) {
+		if subUrl == "" {
+			http.Error(w, "subscription is not enabled", http.StatusConflict)
+			return
 		}
-	}()
-	for {
-		select {
-		case <-ctx.Done():
-			break
-		case <-restart:
-			slog.Info("stop core...")
-			var (
-				maxTries = 3
-				tried    = 0
-			)
-			cmd := (*exec.Cmd)(atomic.LoadPointer(pup))
-			if cmd == nil || cmd.Process == nil {
-				slog.Info("no core is running, ignore.")
-				continue
+		handleTrigger(w, r, subTrigger.fire("An API request recieved, "))
+	})
+	http.HandleFunc("/api/sub/check", func(w http.ResponseWriter, r *http.Request) {
+		if subUrl == "" || !enableCheck {
+			http.Error(w, "connectivity check is not enabled", http.StatusConflict)
+			return
+		}
+		handleTrigger(w, r, checkTrigger.fire("An API request recieved, "))
+	})
+	http.HandleFunc("/api/sub/throughput", func(w http.ResponseWriter, r *http.Request) {
+		if !throughputRunning.CompareAndSwap(false, true) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		go func() {
+			defer throughputRunning.Store(false)
+			slog.Info("An API request recieved, test throughput...")
+			if changed := doThroughput(ctx, filename); changed {
+				slog.Info("balancer endpoints re-ranked by throughput")
+				applyChange(ctx, filename, restartNotify)
 			}
-			for tried < maxTries {
-				if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
-					slog.Warn("killing core with signal TERM fail", slog.ErrorKey, err)
-				} else {
-					slog.Info("Signal TERM has bean send to core.")
-					break
-				}
-				tried++
+		}()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	http.HandleFunc("/api/status", handleStatus)
+	http.HandleFunc("/api/endpoints", handleEndpoints)
+	http.HandleFunc("/api/config", handleConfig)
+	http.HandleFunc("/api/events", handleEvents)
+	http.HandleFunc("/api/traffic", handleTraffic)
+	http.HandleFunc("/api/base-config", handleBaseConfig(ctx, filename, restartNotify))
+	http.HandleFunc("/api/base-config/history", handleBaseHistory)
+	http.HandleFunc("/api/base-config/rollback/", handleBaseRollback(ctx, filename, restartNotify))
+	http.HandleFunc("/metrics", handleMetrics)
+	http.Handle("/", dashboard())
+	http.HandleFunc("/api/check/status", func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		status := struct {
+			AllDown  bool   `json:"allDown"`
+			Policy   string `json:"policy"`
+			Fallback string `json:"fallback,omitempty"`
+			Balanced int    `json:"balanced"`
+			Total    int    `json:"total"`
+		}{
+			AllDown:  allDown,
+			Policy:   check.AllDownPolicy(),
+			Balanced: len(balancedTags()),
+			Total:    len(lastSubEps),
+		}
+		mux.Unlock()
+		if status.Policy == check.AllDownFallback {
+			status.Fallback = check.FallbackTag()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+	http.HandleFunc("/api/check/results", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(check.Reports())
+	})
+	http.HandleFunc("/api/check/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			records := check.History(tag)
+			if n, _ := strconv.Atoi(r.URL.Query().Get("n")); n > 0 && n < len(records) {
+				records = records[len(records)-n:]
 			}
+			_ = json.NewEncoder(w).Encode(records)
+			return
 		}
-	}
-}
-
-func startApi(ctx context.Context, subNotify chan string, checkNotify chan string, restartNotify chan struct{}) {
-	http.HandleFunc("/api/sub", func(w http.ResponseWriter, r *http.Request) {
-		subNotify <- fmt.Sprintf("An API request recieved, ")
-		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(check.Stats())
 	})
-	http.HandleFunc("/api/sub/check", func(w http.ResponseWriter, r *http.Request) {
-		checkNotify <- fmt.Sprintf("An API request recieved, ")
-		w.WriteHeader(http.StatusAccepted)
+	http.HandleFunc("/api/overrides", handleOverrides(ctx, filename, "", restartNotify))
+	http.HandleFunc("/api/overrides/pin", handleOverrides(ctx, filename, "pin", restartNotify))
+	http.HandleFunc("/api/overrides/exclude", handleOverrides(ctx, filename, "exclude", restartNotify))
+	http.HandleFunc("/api/overrides/clear", handleOverrides(ctx, filename, "clear", restartNotify))
+	http.HandleFunc("/api/core/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(supervisor.Status())
+	})
+	http.HandleFunc("/api/core/logs", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(coreLogs.List(n, r.URL.Query().Get("level")))
 	})
 	http.HandleFunc("/api/core/restart", func(w http.ResponseWriter, r *http.Request) {
 		restartNotify <- struct{}{}
 		w.WriteHeader(http.StatusAccepted)
 	})
-	server := http.Server{
-		Addr: fmt.Sprintf(":%d", apiPort),
-	}
-	go func() {
-		<-ctx.Done()
-		_ = server.Shutdown(context.Background())
-	}()
-	if err := server.ListenAndServe(); err != nil && !errors.As(err, http.ErrServerClosed) {
-		slog.Error("serving api failed", err)
-	}
+	serveApi(ctx, http.DefaultServeMux)
 }
 
+// readConfig reads the source config, which is left as is: edits made
+// through the API are kept in the state directory.
 func readConfig() error {
 	data, err := os.ReadFile(v2rayConfig)
 	if err != nil {
@@ -214,72 +331,107 @@ func readConfig() error {
 	if err != nil {
 		return err
 	}
-	servingCfg = cfg
+	if _, err := decodeConfig(data); err != nil {
+		slog.Warn("source config has fields the controller does not know, they are left out", slog.ErrorKey, err)
+	}
+	if edited, err := loadBaseState(data); err != nil {
+		slog.Warn("loading edited base config failed, use source config", slog.ErrorKey, err)
+	} else if edited != nil {
+		slog.Info("use base config edited through api")
+		cfg = edited
+	}
+	baseCfg, servingCfg = cfg, cfg
 	return nil
 }
 
+// renderConfig writes the serving config for the core in the state directory.
 func renderConfig() (string, error) {
-	data, err := json.Marshal(servingCfg)
-	if err != nil {
-		return "", errors.Wrap(err, "marshalling config failed")
+	dir := runDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "creating run dir failed")
 	}
-	tmpDir, err := os.MkdirTemp("", "v2ray-*")
-	if err != nil {
-		return "", errors.Wrap(err, "creating tmp dir failed")
-	}
-	filename := filepath.Join(tmpDir, "config.json")
-	err = os.WriteFile(filename, data, 0644)
-	if err != nil {
-		return "", errors.Wrap(err, "writing config file failed")
+	filename := filepath.Join(dir, "config.json")
+	if err := writeConfig(filename, servingCfg); err != nil {
+		return "", err
 	}
 	return filename, nil
 }
 
-func checkLoop(ctx context.Context, filename string, notify chan string, restartNotify chan<- struct{}) {
-	go func() {
-		for {
-			reason, ok := <-notify
-			if !ok {
-				break
-			}
-			slog.Info(fmt.Sprintf("%scheck connectivity...", reason))
-			if changed := doCheck(ctx, filename); !changed {
-				continue
-			}
-			slog.Info("balancer endpoints updated, restart core...")
-			restartNotify <- struct{}{}
-		}
-	}()
+func checkLoop(ctx context.Context, filename string, trigger *trigger, restartNotify chan<- struct{}) {
 	for {
 		select {
 		case <-ctx.Done():
 			slog.Info("stop endpoint checking loop")
-			close(notify)
 			return
 		case <-time.After(subPeriod):
-			notify <- fmt.Sprintf("%f seconds passed", subPeriod.Seconds())
+			trigger.fire(fmt.Sprintf("%f seconds passed, ", subPeriod.Seconds()))
+		case <-trigger.wake:
+			r := trigger.take()
+			if r == nil {
+				continue
+			}
+			slog.Info(fmt.Sprintf("%scheck connectivity...", r.reason))
+			result, err := doCheck(ctx, filename)
+			if err != nil {
+				slog.Info("checking connectivity skipped", slog.ErrorKey, err)
+				result.Error = err.Error()
+			} else if result.Changed {
+				slog.Info("balancer endpoints updated")
+				result.Restarted = applyChange(ctx, filename, restartNotify)
+			}
+			result.Results = check.Reports()
+			r.finish(result)
 		}
 	}
 }
 
-func doCheck(ctx context.Context, filename string) bool {
+func doCheck(ctx context.Context, filename string) (result CheckResult, err error) {
+	defer func() {
+		recordErr := err
+		if recordErr == nil && result.AllDown {
+			recordErr = errors.Errorf("all %d endpoints are down", result.Checked)
+		}
+		recordSync(&lastCheck, result.Changed, result.Healthy, recordErr)
+	}()
+	if !supervisor.waitReady(ctx, coreReady) {
+		return result, errors.Errorf("core is not ready")
+	}
 	mux.Lock()
 	defer mux.Unlock()
 	if len(lastSubEps) == 0 {
-		return false
+		return result, nil
 	}
 	newEps := check.Check(ctx, lastSubEps)
-	lastShares, newShares := make([]string, len(checkOkEps)), make([]string, len(newEps))
-	for i, ep := range checkOkEps {
-		lastShares[i] = ep.Share()
-	}
-	for i, ep := range newEps {
-		newShares[i] = ep.Share()
+	publishHealth(check.Reports())
+	result.Checked, result.Healthy = len(lastSubEps), len(newEps)
+	observeCheck(result.Checked, result.Healthy)
+	historyChanged()
+	allDown = len(newEps) == 0
+	result.AllDown = allDown
+	if allDown {
+		slog.Error(fmt.Sprintf("applying all-down policy %q", check.AllDownPolicy()),
+			errors.Errorf("all %d endpoints failed the check", len(lastSubEps)))
+		switch check.AllDownPolicy() {
+		case check.AllDownKeep:
+			return result, nil
+		case check.AllDownAll:
+			newEps = lastSubEps
+		}
 	}
-	if reflect.DeepEqual(newShares, lastShares) {
-		return false
+	result.Changed = balance(filename, newEps)
+	return result, nil
+}
+
+func balance(filename string, newEps []sub.Endpoint) bool {
+	var (
+		newCfg *vc.Config
+		err    error
+	)
+	if len(newEps) == 0 {
+		newCfg, err = check.Fallback(servingCfg)
+	} else {
+		newCfg, err = check.Balance(servingCfg, newEps)
 	}
-	newCfg, err := check.Balance(servingCfg, newEps)
 	if err != nil {
 		slog.Warn("balancing failed", slog.ErrorKey, err)
 		return false
@@ -289,55 +441,129 @@ func doCheck(ctx context.Context, filename string) bool {
 		slog.Warn("marshalling new config failed", slog.ErrorKey, err)
 		return false
 	}
-	err = os.WriteFile(filename, data, 0644)
+	if oldData, err := json.Marshal(servingCfg); err == nil && bytes.Equal(data, oldData) {
+		checkOkEps = newEps
+		return false
+	}
+	err = writeConfig(filename, newCfg)
 	if err != nil {
-		slog.Warn("writing new config content failed")
+		slog.Warn("writing new config content failed", slog.ErrorKey, err)
 		return false
 	}
+	publishBalancers(servingCfg, newCfg)
 	servingCfg = newCfg
 	checkOkEps = newEps
 	return true
 }
 
-func subLoop(ctx context.Context, filename string, notify chan string, restartNotify chan<- struct{}) {
-	go func() {
-		for {
-			reason, ok := <-notify
-			if !ok {
-				break
-			}
-			slog.Info(fmt.Sprintf("%scheck subscription...", reason))
-			changed, err := doSubscribe(filename)
-			if err != nil {
-				slog.Warn("checking subscription failed, keep using previous config", slog.ErrorKey, err)
-				continue
-			}
-			if !changed {
-				continue
-			}
-			slog.Info("config is modified by subscription, restart core...")
-			restartNotify <- struct{}{}
+func historyFile() string {
+	return filepath.Join(stateDir, "history.json")
+}
+
+// historyDirty coalesces the requests of saving the check history, which is
+// written by historyLoop rather than by the check holding mux.
+var historyDirty = make(chan struct{}, 1)
+
+func historyChanged() {
+	select {
+	case historyDirty <- struct{}{}:
+	default:
+	}
+}
+
+func historyLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-historyDirty:
 		}
-	}()
+		if err := check.SaveHistory(historyFile()); err != nil {
+			slog.Warn("saving check history failed", slog.ErrorKey, err)
+		}
+	}
+}
+
+func doThroughput(ctx context.Context, filename string) bool {
+	mux.Lock()
+	eps := lastSubEps
+	mux.Unlock()
+	if len(eps) == 0 {
+		return false
+	}
+	if !supervisor.waitReady(ctx, coreReady) {
+		slog.Info("core is not ready, skip throughput test")
+		return false
+	}
+	check.MeasureThroughput(ctx, eps)
+	if check.RankBy() != check.RankThroughput {
+		return false
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	eps = balancedEps()
+	if len(eps) == 0 {
+		return false
+	}
+	return balance(filename, eps)
+}
+
+func subLoop(ctx context.Context, filename string, trigger *trigger, restartNotify chan<- struct{}) {
 	for {
 		select {
 		case <-ctx.Done():
 			slog.Info("stop subscription checking loop")
-			close(notify)
 			return
 		case <-time.After(subPeriod):
-			notify <- fmt.Sprintf("%f seconds passed, ", subPeriod.Seconds())
+			trigger.fire(fmt.Sprintf("%f seconds passed, ", subPeriod.Seconds()))
+		case <-trigger.wake:
+			r := trigger.take()
+			if r == nil {
+				continue
+			}
+			slog.Info(fmt.Sprintf("%scheck subscription...", r.reason))
+			result, err := doSubscribe(filename)
+			if err != nil {
+				slog.Warn("checking subscription failed, keep using previous config", slog.ErrorKey, err)
+				result.Error = err.Error()
+			} else if result.Changed {
+				slog.Info("config is modified by subscription")
+				result.Restarted = applyChange(ctx, filename, restartNotify)
+			}
+			r.finish(result)
 		}
 	}
 }
 
-func doSubscribe(filename string) (bool, error) {
+func doSubscribe(filename string) (result SubResult, err error) {
 	if subUrl == "" {
-		return false, nil
-	}
-	newEps, err := sub.FetchEndpoints(subUrl)
+		return result, nil
+	}
+	var fetchTook time.Duration
+	defer func() {
+		recordSync(&lastSub, result.Changed, result.Endpoints, err)
+		observeSubFetch(fetchTook, result.Parsed, result.Rejected, err)
+		fetched := result
+		if err != nil {
+			fetched.Error = err.Error()
+		}
+		events.publish(EventSubFetched, fetched)
+		if result.Changed {
+			events.publish(EventSubChanged, fetched)
+		}
+	}()
+	fetchStart := time.Now()
+	newEps, rejected, err := sub.FetchEndpoints(subUrl)
+	fetchTook = time.Since(fetchStart)
+	result.Parsed, result.Rejected = len(newEps), rejected
 	if err != nil {
-		return false, err
+		return result, err
+	}
+	newEps = supportedEndpoints(newEps)
+	result.Endpoints = len(newEps)
+	result.Rejected += result.Parsed - result.Endpoints
+	if len(newEps) == 0 {
+		return result, errors.Errorf("none endpoint is supported by core %s", coreDriver.Name())
 	}
 	mux.Lock()
 	defer mux.Unlock()
@@ -349,34 +575,46 @@ func doSubscribe(filename string) (bool, error) {
 		lastShares[i] = ep.Share()
 	}
 	if reflect.DeepEqual(newShares, lastShares) {
-		return false, nil
+		return result, nil
 	}
-	newCfg, err := sub.Override(servingCfg, newEps)
+	newCfg, balanced, err := buildConfig(baseCfg, newEps)
 	if err != nil {
-		return false, err
+		return result, err
 	}
-	data, err := json.Marshal(newCfg)
-	if err != nil {
-		return false, errors.Wrap(err, "marshalling new config failed")
+	if err := saveEndpoints(newEps); err != nil {
+		slog.Warn("saving endpoints failed", slog.ErrorKey, err)
 	}
-	if err := os.WriteFile(v2rayConfig, data, 0644); err != nil {
-		slog.Warn("update source config via subscription failed", slog.ErrorKey, err)
-	}
-	err = os.WriteFile(filename, data, 0644)
+	err = writeConfig(filename, newCfg)
 	if err != nil {
-		return false, errors.Wrap(err, "writing new config content failed")
+		return result, errors.Wrap(err, "writing new config content failed")
 	}
+	publishBalancers(servingCfg, newCfg)
 	servingCfg = newCfg
 	lastSubEps = newEps
-	checkOkEps = newEps
-	return true, nil
+	checkOkEps = balanced
+	allDown = false
+	result.Changed = true
+	return result, nil
+}
+
+// supportedEndpoints leaves out the endpoints the core cannot run.
+func supportedEndpoints(eps []sub.Endpoint) []sub.Endpoint {
+	supported := make([]sub.Endpoint, 0, len(eps))
+	for _, ep := range eps {
+		if err := coreDriver.Supports(ep.Outbound()); err != nil {
+			slog.Warn(fmt.Sprintf("endpoint %s skipped: %s", ep.Tag(), err))
+			continue
+		}
+		supported = append(supported, ep)
+	}
+	return supported
 }
 
-func coreCmd(ctx context.Context, filename string) *exec.Cmd {
-	cmd := exec.CommandContext(ctx, v2rayBin, "-config", filename)
-	cmd.Env = append(cmd.Env, fmt.Sprintf("V2RAY_LOCATION_ASSET=%s", v2rayAsset))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func coreCmd(filename string, out io.Writer) *exec.Cmd {
+	cmd := exec.Command(v2rayBin, coreDriver.Args(filename, v2rayAsset)...)
+	cmd.Env = append(cmd.Env, coreDriver.Env(v2rayAsset)...)
+	cmd.Stdout = out
+	cmd.Stderr = out
 	return cmd
 }
 
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metricsMux        = &sync.Mutex{}
+	subFetches        uint64
+	subFetchErrors    uint64
+	subFetchSeconds   float64
+	subLastFetch      float64
+	subLastSuccess    time.Time
+	subParsed         int
+	subRejected       int
+	checkRuns         uint64
+	checkEndpointRuns = map[bool]uint64{}
+)
+
+// observeSubFetch records a subscription fetch that took d.
+func observeSubFetch(d time.Duration, parsed int, rejected int, err error) {
+	metricsMux.Lock()
+	defer metricsMux.Unlock()
+	subFetches++
+	subLastFetch = d.Seconds()
+	subFetchSeconds += subLastFetch
+	if err != nil {
+		subFetchErrors++
+		return
+	}
+	subLastSuccess, subParsed, subRejected = time.Now(), parsed, rejected
+}
+
+// observeCheck records a check of checked endpoints, healthy of which passed.
+func observeCheck(checked int, healthy int) {
+	metricsMux.Lock()
+	defer metricsMux.Unlock()
+	checkRuns++
+	checkEndpointRuns[true] += uint64(healthy)
+	checkEndpointRuns[false] += uint64(checked - healthy)
+}
+
+// metricWriter writes metrics in the prometheus text exposition format.
+type metricWriter struct {
+	buf bytes.Buffer
+}
+
+func (m *metricWriter) family(name string, typ string, help string) {
+	_, _ = fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of name, labels are given as name and value pairs.
+func (m *metricWriter) sample(name string, value float64, labels ...string) {
+	m.buf.WriteString(name)
+	if len(labels) > 0 {
+		m.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.buf.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(&m.buf, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		m.buf.WriteByte('}')
+	}
+	m.buf.WriteByte(' ')
+	m.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.buf.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	m := &metricWriter{}
+	writeEndpointMetrics(m)
+	writeSyncMetrics(m)
+	writeCoreMetrics(m)
+	if trafficStats {
+		writeTrafficMetrics(m)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(m.buf.Bytes())
+}
+
+// writeEndpointMetrics labels the series of endpoints by tag, which is unique
+// as repeated tags are renamed when the subscription is decoded.
+func writeEndpointMetrics(m *metricWriter) {
+	statuses := endpointStatuses()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Tag < statuses[j].Tag
+	})
+	m.family("vc_endpoint_up", "gauge", "Whether the endpoint passed the latest check.")
+	for _, s := range statuses {
+		if s.Health != "unchecked" {
+			m.sample("vc_endpoint_up", boolValue(s.Health == "healthy"), "tag", s.Tag, "protocol", s.Protocol)
+		}
+	}
+	m.family("vc_endpoint_latency_milliseconds", "gauge", "Mean latency of the successful targets in the latest check.")
+	for _, s := range statuses {
+		if s.LatencyMs > 0 {
+			m.sample("vc_endpoint_latency_milliseconds", float64(s.LatencyMs), "tag", s.Tag)
+		}
+	}
+	m.family("vc_endpoint_in_balancer", "gauge", "Whether the endpoint is selected by the main balancer.")
+	for _, s := range statuses {
+		m.sample("vc_endpoint_in_balancer", boolValue(s.InBalancer), "tag", s.Tag)
+	}
+}
+
+func writeSyncMetrics(m *metricWriter) {
+	mux.Lock()
+	endpoints, balanced, down := len(lastSubEps), len(balancedTags()), allDown
+	mux.Unlock()
+	metricsMux.Lock()
+	defer metricsMux.Unlock()
+	m.family("vc_endpoints", "gauge", "Endpoints of the latest subscription the core supports.")
+	m.sample("vc_endpoints", float64(endpoints))
+	m.family("vc_endpoints_balanced", "gauge", "Endpoints selected by the main balancer.")
+	m.sample("vc_endpoints_balanced", float64(balanced))
+	m.family("vc_endpoints_all_down", "gauge", "Whether every endpoint failed the latest check.")
+	m.sample("vc_endpoints_all_down", boolValue(down))
+	m.family("vc_sub_fetches_total", "counter", "Subscription fetches.")
+	m.sample("vc_sub_fetches_total", float64(subFetches))
+	m.family("vc_sub_fetch_errors_total", "counter", "Subscription updates that failed.")
+	m.sample("vc_sub_fetch_errors_total", float64(subFetchErrors))
+	m.family("vc_sub_fetch_duration_seconds", "summary", "Duration of subscription fetches.")
+	m.sample("vc_sub_fetch_duration_seconds_sum", subFetchSeconds)
+	m.sample("vc_sub_fetch_duration_seconds_count", float64(subFetches))
+	m.family("vc_sub_last_fetch_duration_seconds", "gauge", "Duration of the latest subscription fetch.")
+	m.sample("vc_sub_last_fetch_duration_seconds", subLastFetch)
+	m.family("vc_sub_endpoints_parsed", "gauge", "Endpoints parsed from the latest successful subscription fetch.")
+	m.sample("vc_sub_endpoints_parsed", float64(subParsed))
+	m.family("vc_sub_endpoints_rejected", "gauge", "Entries rejected from the latest successful subscription fetch.")
+	m.sample("vc_sub_endpoints_rejected", float64(subRejected))
+	if !subLastSuccess.IsZero() {
+		m.family("vc_sub_last_success_timestamp_seconds", "gauge", "Time of the latest successful subscription fetch.")
+		m.sample("vc_sub_last_success_timestamp_seconds", float64(subLastSuccess.Unix()))
+	}
+	m.family("vc_check_runs_total", "counter", "Connectivity checks.")
+	m.sample("vc_check_runs_total", float64(checkRuns))
+	m.family("vc_check_endpoint_results_total", "counter", "Endpoint results of connectivity checks.")
+	m.sample("vc_check_endpoint_results_total", float64(checkEndpointRuns[true]), "result", "healthy")
+	m.sample("vc_check_endpoint_results_total", float64(checkEndpointRuns[false]), "result", "unhealthy")
+}
+
+func writeCoreMetrics(m *metricWriter) {
+	status := supervisor.Status()
+	m.family("vc_core_up", "gauge", "Whether the core is running.")
+	m.sample("vc_core_up", boolValue(status.State == CoreRunning), "driver", coreDriver.Name())
+	m.family("vc_core_ready", "gauge", "Whether the core is ready to serve.")
+	m.sample("vc_core_ready", boolValue(status.Ready))
+	m.family("vc_core_restarts_total", "counter", "Core restarts.")
+	m.sample("vc_core_restarts_total", float64(status.Restarts))
+	m.family("vc_core_consecutive_crashes", "gauge", "Core crashes in a row.")
+	m.sample("vc_core_consecutive_crashes", float64(status.Crashes))
+	m.family("vc_core_uptime_seconds", "gauge", "Seconds since the running core started.")
+	uptime := 0.0
+	if status.Pid != 0 && status.StartedAt != nil {
+		uptime = time.Since(*status.StartedAt).Seconds()
+	}
+	m.sample("vc_core_uptime_seconds", uptime)
+}
+
+func writeTrafficMetrics(m *metricWriter) {
+	totals := trafficTotals()
+	for _, group := range []struct {
+		kind   string
+		label  string
+		totals map[string]*Traffic
+	}{
+		{"outbound", "tag", totals.Endpoints},
+		{"inbound", "tag", totals.Inbounds},
+		{"user", "email", totals.Users},
+	} {
+		tags := make([]string, 0, len(group.totals))
+		for tag := range group.totals {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for _, direction := range []string{"uplink", "downlink"} {
+			name := fmt.Sprintf("vc_%s_%s_bytes_total", group.kind, direction)
+			m.family(name, "counter", fmt.Sprintf("Bytes of %s traffic by %s.", direction, group.kind))
+			for _, tag := range tags {
+				value := group.totals[tag].Uplink
+				if direction == "downlink" {
+					value = group.totals[tag].Downlink
+				}
+				m.sample(name, float64(value), group.label, tag)
+			}
+		}
+	}
+}
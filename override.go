@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"path/filepath"
+	"vc/sub/check"
+)
+
+func overridesFile() string {
+	return filepath.Join(stateDir, "overrides.json")
+}
+
+// handleOverrides shows the overrides on GET, and on other methods updates
+// them by the action and re-balances at once.
+func handleOverrides(ctx context.Context, filename string, action string, restartNotify chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || action == "" {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(check.GetOverrides())
+			return
+		}
+		var req struct {
+			Tags []string `json:"tags"`
+		}
+		if action != "clear" {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+				return
+			}
+			if unknown := unknownTags(req.Tags); len(unknown) > 0 {
+				http.Error(w, fmt.Sprintf("unknown endpoints: %v", unknown), http.StatusBadRequest)
+				return
+			}
+		}
+		switch action {
+		case "pin":
+			check.Pin(req.Tags)
+		case "exclude":
+			check.Exclude(req.Tags)
+		default:
+			check.ClearOverrides()
+		}
+		slog.Info(fmt.Sprintf("An API request recieved, %s endpoints %v", action, req.Tags))
+		if err := check.SaveOverrides(overridesFile()); err != nil {
+			slog.Warn("saving overrides failed", slog.ErrorKey, err)
+		}
+		mux.Lock()
+		eps := balancedEps()
+		changed := servingCfg != nil && len(eps) > 0 && balance(filename, eps)
+		mux.Unlock()
+		if changed {
+			slog.Info("balancer endpoints changed by overrides")
+			applyChange(ctx, filename, restartNotify)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(check.GetOverrides())
+	}
+}
+
+// unknownTags returns the tags not found in the latest subscription.
+func unknownTags(tags []string) []string {
+	mux.Lock()
+	defer mux.Unlock()
+	known := make(map[string]bool, len(lastSubEps))
+	for _, ep := range lastSubEps {
+		known[ep.Tag()] = true
+	}
+	var unknown []string
+	for _, tag := range tags {
+		if !known[tag] {
+			unknown = append(unknown, tag)
+		}
+	}
+	return unknown
+}
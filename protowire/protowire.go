@@ -0,0 +1,94 @@
+package protowire
+
+import (
+	"github.com/pkg/errors"
+)
+
+// The API of the cores and the geoip files are protobuf, of which the few
+// messages used are encoded and decoded by hand with these helpers.
+
+func AppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func AppendVarintField(b []byte, field int, v uint64) []byte {
+	return AppendVarint(AppendVarint(b, uint64(field)<<3), v)
+}
+
+// AppendBoolField appends nothing for false, the default value.
+func AppendBoolField(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return AppendVarintField(b, field, 1)
+}
+
+func AppendBytesField(b []byte, field int, v []byte) []byte {
+	b = AppendVarint(AppendVarint(b, uint64(field)<<3|2), uint64(len(v)))
+	return append(b, v...)
+}
+
+func AppendStringField(b []byte, field int, v string) []byte {
+	return AppendBytesField(b, field, []byte(v))
+}
+
+// Walk iterates over the fields of a protobuf message. Varint values are
+// passed as their raw encoding, length-delimited values as their payload.
+func Walk(data []byte, fn func(field int, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := ReadVarint(data)
+		if n <= 0 {
+			return errors.Errorf("invalid field key")
+		}
+		data = data[n:]
+		field, wire := int(key>>3), key&7
+		var value []byte
+		switch wire {
+		case 0:
+			_, n = ReadVarint(data)
+			if n <= 0 {
+				return errors.Errorf("invalid varint of field %d", field)
+			}
+			value, data = data[:n], data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errors.Errorf("truncated field %d", field)
+			}
+			value, data = data[:8], data[8:]
+		case 2:
+			l, n := ReadVarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return errors.Errorf("truncated field %d", field)
+			}
+			value, data = data[n:n+int(l)], data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return errors.Errorf("truncated field %d", field)
+			}
+			value, data = data[:4], data[4:]
+		default:
+			return errors.Errorf("unsupported wire type %d of field %d", wire, field)
+		}
+		if err := fn(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadVarint returns a varint at the start of data and its length, which is
+// 0 if data does not start with a valid varint.
+func ReadVarint(data []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		v |= uint64(data[i]&0x7f) << (7 * i)
+		if data[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
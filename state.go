@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"os"
+	"path/filepath"
+	"vc/sub"
+	"vc/sub/check"
+	"vc/vc"
+)
+
+// The source config is never written. What the controller generates lives in
+// the state directory: the endpoints of the latest subscription, the base
+// config as edited through the API, and the config files the core runs with.
+// The serving config is always rebuilt from the base config and endpoints.
+
+func endpointsFile() string {
+	return filepath.Join(stateDir, "endpoints.json")
+}
+
+func baseStateFile() string {
+	return filepath.Join(stateDir, "base-config.json")
+}
+
+func runDir() string {
+	return filepath.Join(stateDir, "run")
+}
+
+// writeState writes a state file through a temporary file, so that it is
+// never seen half written.
+func writeState(filename string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func saveEndpoints(eps []sub.Endpoint) error {
+	shares := make([]string, len(eps))
+	for i, ep := range eps {
+		shares[i] = ep.Share()
+	}
+	data, err := json.Marshal(shares)
+	if err != nil {
+		return errors.Wrap(err, "encoding endpoints failed")
+	}
+	return errors.Wrap(writeState(endpointsFile(), data), "writing endpoints file failed")
+}
+
+func loadEndpoints() ([]sub.Endpoint, error) {
+	data, err := os.ReadFile(endpointsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "reading endpoints file failed")
+	}
+	var shares []string
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, errors.Wrap(err, "decoding endpoints file failed")
+	}
+	eps := make([]sub.Endpoint, 0, len(shares))
+	for _, share := range shares {
+		ep, err := sub.FromShareUrl(share)
+		if err != nil {
+			slog.Warn("parsing saved endpoint failed", slog.ErrorKey, err)
+			continue
+		}
+		eps = append(eps, ep)
+	}
+	return sub.UniqueTags(eps), nil
+}
+
+// restoreEndpoints serves the endpoints of the latest subscription until it
+// is fetched again. They are restored unchecked, the next check decides which
+// of them are healthy.
+func restoreEndpoints() error {
+	eps, err := loadEndpoints()
+	if err != nil || len(eps) == 0 {
+		return err
+	}
+	eps = supportedEndpoints(eps)
+	if len(eps) == 0 {
+		return nil
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	cfg, _, err := buildConfig(baseCfg, eps)
+	if err != nil {
+		return err
+	}
+	servingCfg, lastSubEps, checkOkEps = cfg, eps, nil
+	slog.Info(fmt.Sprintf("%d endpoints restored from state", len(eps)))
+	return nil
+}
+
+// buildConfig builds the serving config from base and eps. The same inputs
+// always make the same config: the balancers select the endpoints the check
+// has not marked down when it is enabled, with the overrides applied. It
+// returns the endpoints balanced.
+func buildConfig(base *vc.Config, eps []sub.Endpoint) (*vc.Config, []sub.Endpoint, error) {
+	cfg, err := sub.Override(base, eps)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !enableCheck && !check.HasOverrides() {
+		return cfg, eps, nil
+	}
+	balanced := eps
+	if enableCheck {
+		// the all-down policy is left to the next check
+		if available := check.Available(eps); len(available) > 0 {
+			balanced = available
+		}
+	}
+	balancedCfg, err := check.Balance(cfg, balanced)
+	if err != nil {
+		slog.Warn("balancing endpoints failed", slog.ErrorKey, err)
+		return cfg, eps, nil
+	}
+	return balancedCfg, balanced, nil
+}
+
+// balancedEps returns the endpoints to balance: those that passed the latest
+// check, or until the endpoints are checked, those not marked down. mux
+// should be held.
+func balancedEps() []sub.Endpoint {
+	if checkOkEps != nil {
+		return checkOkEps
+	}
+	return check.Available(lastSubEps)
+}
+
+// baseState is the base config edited through the API, for the source config
+// of checksum Source. Once the source config changes, it wins over the edits.
+type baseState struct {
+	Source string          `json:"source"`
+	Config json.RawMessage `json:"config"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadBaseState returns the edited base config if it is still based on the
+// source config.
+func loadBaseState(source []byte) (*vc.Config, error) {
+	data, err := os.ReadFile(baseStateFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "reading base config state failed")
+	}
+	state := baseState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrap(err, "decoding base config state failed")
+	}
+	if state.Source != checksum(source) {
+		slog.Info("source config changed since the base config was edited, edits are discarded")
+		return nil, nil
+	}
+	return decodeConfig(state.Config)
+}
+
+func saveBaseState(base *vc.Config) error {
+	source, err := os.ReadFile(v2rayConfig)
+	if err != nil {
+		return errors.Wrap(err, "reading source config failed")
+	}
+	cfg, err := json.Marshal(base)
+	if err != nil {
+		return errors.Wrap(err, "marshalling base config failed")
+	}
+	data, err := json.Marshal(baseState{Source: checksum(source), Config: cfg})
+	if err != nil {
+		return errors.Wrap(err, "encoding base config state failed")
+	}
+	return errors.Wrap(writeState(baseStateFile(), data), "writing base config state failed")
+}
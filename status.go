@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"vc/sub"
+	"vc/sub/check"
+	"vc/vc"
+)
+
+// SyncResult is the outcome of the latest subscription update or check.
+type SyncResult struct {
+	At        time.Time `json:"at"`
+	Ok        bool      `json:"ok"`
+	Changed   bool      `json:"changed"`
+	Endpoints int       `json:"endpoints"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	statusMux = &sync.Mutex{}
+	lastSub   *SyncResult
+	lastCheck *SyncResult
+	// redactKeys are the secret fields of the cores, lower case without
+	// separators, besides the ones named after redactWords
+	redactKeys = map[string]bool{
+		"id":       true,
+		"uuid":     true,
+		"pass":     true,
+		"psk":      true,
+		"seed":     true,
+		"auth":     true,
+		"authstr":  true,
+		"shortid":  true,
+		"shortids": true,
+	}
+	redactWords = []string{"password", "secret", "token", "key"}
+)
+
+func recordSync(result **SyncResult, changed bool, endpoints int, err error) {
+	statusMux.Lock()
+	defer statusMux.Unlock()
+	*result = &SyncResult{At: time.Now(), Ok: err == nil, Changed: changed, Endpoints: endpoints}
+	if err != nil {
+		(*result).Error = err.Error()
+	}
+}
+
+type Status struct {
+	Core         CoreStatus  `json:"core"`
+	Driver       string      `json:"driver"`
+	UptimeSec    int64       `json:"uptimeSec"`
+	Sub          *SyncResult `json:"sub,omitempty"`
+	Check        *SyncResult `json:"check,omitempty"`
+	Endpoints    int         `json:"endpoints"`
+	Balanced     int         `json:"balanced"`
+	AllDown      bool        `json:"allDown"`
+	HotUpdate    bool        `json:"hotUpdate"`
+	BlueGreen    bool        `json:"blueGreen"`
+	CheckEnabled bool        `json:"checkEnabled"`
+}
+
+func handleStatus(w http.ResponseWriter, _ *http.Request) {
+	status := Status{
+		Core:         supervisor.Status(),
+		Driver:       coreDriver.Name(),
+		HotUpdate:    hotUpdate,
+		BlueGreen:    blueGreen,
+		CheckEnabled: enableCheck,
+	}
+	if status.Core.Pid != 0 && status.Core.StartedAt != nil {
+		status.UptimeSec = int64(time.Since(*status.Core.StartedAt).Seconds())
+	}
+	statusMux.Lock()
+	status.Sub, status.Check = lastSub, lastCheck
+	statusMux.Unlock()
+	mux.Lock()
+	status.Endpoints, status.Balanced, status.AllDown = len(lastSubEps), len(balancedTags()), allDown
+	mux.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+type EndpointStatus struct {
+	Tag        string     `json:"tag"`
+	Protocol   string     `json:"protocol"`
+	Address    string     `json:"address"`
+	CheckPort  int        `json:"checkPort"`
+	Health     string     `json:"health"`
+	LatencyMs  int64      `json:"latencyMs,omitempty"`
+	CheckedAt  *time.Time `json:"checkedAt,omitempty"`
+	InBalancer bool       `json:"inBalancer"`
+}
+
+func handleEndpoints(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(endpointStatuses())
+}
+
+func endpointStatuses() []EndpointStatus {
+	reports := make(map[string]check.Report)
+	for _, r := range check.Reports() {
+		reports[r.Tag] = r
+	}
+	mux.Lock()
+	eps := make([]sub.Endpoint, len(lastSubEps))
+	copy(eps, lastSubEps)
+	balanced := balancedTags()
+	mux.Unlock()
+	statuses := make([]EndpointStatus, 0, len(eps))
+	for _, ep := range eps {
+		outbound := ep.Outbound()
+		s := EndpointStatus{
+			Tag:        ep.Tag(),
+			Protocol:   outbound.Protocol,
+			Address:    outboundAddress(outbound),
+			CheckPort:  ep.CheckPort(),
+			Health:     "unchecked",
+			InBalancer: balanced[ep.Tag()],
+		}
+		if r, found := reports[ep.Tag()]; found {
+			s.Health = "unhealthy"
+			if r.Healthy {
+				s.Health = "healthy"
+			}
+			at := r.CheckedAt
+			s.CheckedAt = &at
+			var total, n int64
+			for _, t := range r.Targets {
+				if t.Ok {
+					total += t.LatencyMs
+					n++
+				}
+			}
+			if n > 0 {
+				s.LatencyMs = total / n
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// balancedTags returns the endpoint tags the main balancer selects, mux
+// should be held.
+func balancedTags() map[string]bool {
+	tags := map[string]bool{}
+	if servingCfg == nil || servingCfg.Routing == nil || len(servingCfg.Routing.Balancers) == 0 {
+		return tags
+	}
+	for _, tag := range servingCfg.Routing.Balancers[0].Selector {
+		tags[tag] = true
+	}
+	return tags
+}
+
+func outboundAddress(outbound *vc.Outbound) string {
+	settings := outbound.Settings
+	switch {
+	case settings == nil:
+		return ""
+	case len(settings.VNext) > 0:
+		return fmt.Sprintf("%s:%s", settings.VNext[0].Address, settings.VNext[0].Port)
+	case len(settings.Servers) > 0:
+		return fmt.Sprintf("%s:%d", settings.Servers[0].Address, settings.Servers[0].Port)
+	}
+	return ""
+}
+
+func handleConfig(w http.ResponseWriter, _ *http.Request) {
+	mux.Lock()
+	cfg, err := materialize(servingCfg)
+	var data []byte
+	if err == nil {
+		data, err = coreDriver.Render(cfg)
+	}
+	mux.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var rendered any
+	if err := json.Unmarshal(data, &rendered); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(redact(rendered))
+}
+
+// redact replaces the values of secret fields in a decoded json document.
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if _, isMap := value.(map[string]any); !isMap && isSecret(key) {
+				v[key] = "******"
+				continue
+			}
+			v[key] = redact(value)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redact(value)
+		}
+	}
+	return v
+}
+
+// isSecret reports whether a field holds a secret, whatever case and
+// separators the core names its fields with, like privateKey or private_key.
+func isSecret(key string) bool {
+	key = strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+	if redactKeys[key] {
+		return true
+	}
+	for _, word := range redactWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
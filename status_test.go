@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	var doc any
+	err := json.Unmarshal([]byte(`{
+		"outbounds": [
+			{"tag": "a", "settings": {"vnext": [{"address": "a.example.com", "port": 443, "users": [{"id": "uuid"}]}]},
+				"streamSettings": {"realitySettings": {"serverName": "a.example.com", "publicKey": "pbk", "shortId": "sid"}}},
+			{"tag": "b", "type": "hysteria", "server": "b.example.com", "auth_str": "auth", "obfs": {"password": "p"}},
+			{"tag": "c", "tls": {"reality": {"public_key": "pbk", "short_id": "sid"}}, "Token": "t", "clientSecret": "s"}
+		],
+		"inbounds": [{"tag": "in", "settings": {"clients": [{"password": "p"}]}, "realitySettings": {"shortIds": ["a", "b"]}}]
+	}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want any
+	err = json.Unmarshal([]byte(`{
+		"outbounds": [
+			{"tag": "a", "settings": {"vnext": [{"address": "a.example.com", "port": 443, "users": [{"id": "******"}]}]},
+				"streamSettings": {"realitySettings": {"serverName": "a.example.com", "publicKey": "******", "shortId": "******"}}},
+			{"tag": "b", "type": "hysteria", "server": "b.example.com", "auth_str": "******", "obfs": {"password": "******"}},
+			{"tag": "c", "tls": {"reality": {"public_key": "******", "short_id": "******"}}, "Token": "******", "clientSecret": "******"}
+		],
+		"inbounds": [{"tag": "in", "settings": {"clients": [{"password": "******"}]}, "realitySettings": {"shortIds": "******"}}]
+	}`), &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := redact(doc); !reflect.DeepEqual(got, want) {
+		data, _ := json.Marshal(got)
+		t.Errorf("redact() = %s", data)
+	}
+}
@@ -5,18 +5,24 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"golang.org/x/exp/slog"
-	"net/http"
-	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"vc/sub"
 	"vc/vc"
 )
 
+const (
+	QuorumAny      = "any"
+	QuorumMajority = "majority"
+	QuorumAll      = "all"
+)
+
 var (
 	timeoutSec = 5
-	testUrl    = "https://httpbin.org/get"
+	quorum     = QuorumAll
 )
 
 func init() {
@@ -28,46 +34,145 @@ func init() {
 			timeoutSec = int(i)
 		}
 	}
-	if s, ok := os.LookupEnv("VC_CHECK_URL"); ok {
-		_, err := url.Parse(s)
-		if err != nil {
-			slog.Info(fmt.Sprintf("Invalid check url: %q, use default value: %q", s, testUrl))
+	if s, ok := os.LookupEnv("VC_CHECK_QUORUM"); ok {
+		switch s {
+		case QuorumAny, QuorumMajority, QuorumAll:
+			quorum = s
+		default:
+			slog.Info(fmt.Sprintf("Invalid quorum: %q, use default value: %q", s, quorum))
 		}
-		testUrl = s
 	}
 }
 
-func check(ctx context.Context, ep sub.Endpoint) bool {
-	tr := &http.Transport{
-		Proxy: func(_ *http.Request) (*url.URL, error) {
-			return url.Parse(fmt.Sprintf("socks5://127.0.0.1:%d", ep.CheckPort()))
-		},
-	}
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   time.Second * time.Duration(timeoutSec),
-	}
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, testUrl, nil)
-	resp, err := client.Do(req)
-	if err != nil {
-		slog.Info(fmt.Sprintf("failed accessing %q, via ep: %s: %+v", testUrl, ep.Tag(), err))
-		return false
+type TargetResult struct {
+	Target     string `json:"target"`
+	Ok         bool   `json:"ok"`
+	LatencyMs  int64  `json:"latencyMs"`
+	ErrorClass string `json:"errorClass,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func quorumMet(passed, total int) bool {
+	switch quorum {
+	case QuorumAny:
+		return passed > 0
+	case QuorumMajority:
+		return passed*2 > total
+	default:
+		return passed == total
+	}
+}
+
+type result struct {
+	ok      bool
+	targets []TargetResult
+	exitIp  string
+}
+
+func check(ctx context.Context, ep sub.Endpoint) result {
+	var flat []Probe
+	for _, group := range probes {
+		flat = append(flat, group.Probes...)
+	}
+	results := make([]TargetResult, len(flat))
+	wg := &sync.WaitGroup{}
+	for i, p := range flat {
+		wg.Add(1)
+		go func(i int, p Probe) {
+			defer wg.Done()
+			pCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(timeoutSec))
+			defer cancel()
+			start := time.Now()
+			err := p.Probe(pCtx, ep)
+			results[i] = TargetResult{
+				Target:    p.Name(),
+				Ok:        err == nil,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+				results[i].ErrorClass = classifyError(err)
+				slog.Info(fmt.Sprintf("probe %q failed via ep: %s: %+v", p.Name(), ep.Tag(), err))
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	r := result{ok: true, targets: results}
+	// the quorum applies to the targets of each probe kind, so that many
+	// passing http targets cannot outvote a failing dns probe
+	offset := 0
+	for _, group := range probes {
+		passed := 0
+		total := len(group.Probes)
+		for _, t := range results[offset : offset+total] {
+			if t.Ok {
+				passed++
+			}
+		}
+		offset += total
+		if !quorumMet(passed, total) {
+			slog.Info(fmt.Sprintf("ep %s passed %d/%d %s probes, quorum %q not met",
+				ep.Tag(), passed, total, group.Kind, quorum))
+			r.ok = false
+		}
 	}
-	if resp.StatusCode != http.StatusOK {
-		slog.Info(fmt.Sprintf("getting %q responses %s %d, via ep: %s",
-			testUrl, resp.Status, resp.StatusCode, ep.Tag()))
-		return false
+	if !r.ok {
+		return r
 	}
-	return true
+	if exitIpUrl != "" {
+		ipCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(timeoutSec))
+		defer cancel()
+		ip, err := exitIp(ipCtx, ep)
+		if err != nil {
+			slog.Info(fmt.Sprintf("detecting exit ip via ep %s failed: %+v", ep.Tag(), err))
+		}
+		r.exitIp = ip
+	}
+	return r
 }
 
 func Check(ctx context.Context, eps []sub.Endpoint) []sub.Endpoint {
+	results := make([]result, len(eps))
+	for i, ep := range eps {
+		results[i] = check(ctx, ep)
+	}
+	now := time.Now()
+	healthMux.Lock()
+	defer healthMux.Unlock()
+	states := make(map[string]*health, len(eps))
 	ok := make([]sub.Endpoint, 0, len(eps))
-	for _, ep := range eps {
-		if check(ctx, ep) {
+	for i, ep := range eps {
+		h, found := healths[ep.Share()]
+		if !found {
+			h = &health{}
+		}
+		h.tag = ep.Tag()
+		h.targets = results[i].targets
+		if results[i].exitIp != "" && results[i].exitIp != h.exitIp {
+			h.exitIp = results[i].exitIp
+			h.country = Country(h.exitIp)
+		}
+		if first := h.checkedAt.IsZero(); h.record(results[i].ok) {
+			if h.healthy {
+				slog.Info(fmt.Sprintf("endpoint %s recovered after %d successful checks", ep.Tag(), h.successes))
+			} else {
+				slog.Info(fmt.Sprintf("endpoint %s marked down after %d failed checks", ep.Tag(), h.failures))
+			}
+		} else if first && !h.healthy {
+			slog.Info(fmt.Sprintf("endpoint %s is down at its first check", ep.Tag()))
+		}
+		h.checkedAt = now
+		states[ep.Share()] = h
+		if h.healthy {
 			ok = append(ok, ep)
 		}
 	}
+	healths = states
+	records := make(map[string]Record, len(eps))
+	for i, ep := range eps {
+		records[ep.Share()] = newRecord(now, results[i])
+	}
+	recordHistory(eps, records)
 	return ok
 }
 
@@ -79,10 +184,65 @@ func Balance(cfg *vc.Config, eps []sub.Endpoint) (*vc.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	tags := make([]string, 0, len(eps))
-	for _, ep := range eps {
+	eps, pinned := applyOverrides(cfg, eps)
+	if len(eps) == 0 && len(pinned) == 0 {
+		// keeping the previous selectors would keep routing to the excluded
+		// endpoints
+		tag := fallbackOutbound(cfg)
+		slog.Warn(fmt.Sprintf("all healthy endpoints are excluded, route to %s", tag))
+		for _, b := range cfg.Routing.Balancers {
+			b.Selector = []string{tag}
+		}
+		return cfg, nil
+	}
+	ranked := rank(eps)
+	tags := make([]string, 0, len(ranked))
+	for _, ep := range ranked {
 		tags = append(tags, ep.Tag())
 	}
+	if len(pinned) > 0 {
+		tags = pinned
+	}
 	cfg.Routing.Balancers[0].Selector = tags
+	// country balancers select from every kept endpoint, the top n ranking
+	// only applies to the main balancer
+	for _, b := range cfg.Routing.Balancers[1:] {
+		if !strings.HasPrefix(b.Tag, countryBalancePrefix) {
+			continue
+		}
+		b.Selector = countryTags(eps, strings.TrimPrefix(b.Tag, countryBalancePrefix))
+		if len(b.Selector) == 0 {
+			// fail closed, routing the traffic of the country to a direct
+			// outbound would leak it unproxied
+			slog.Warn(fmt.Sprintf("no endpoint left for balancer %s, block its traffic", b.Tag))
+			b.Selector = []string{blockOutbound(cfg)}
+		}
+	}
 	return cfg, nil
 }
+
+// blockOutbound returns the tag of a blackhole outbound of cfg, adding one
+// if there is none.
+func blockOutbound(cfg *vc.Config) string {
+	for _, outbound := range cfg.Outbounds {
+		if outbound.Protocol == "blackhole" && outbound.Tag != "" {
+			return outbound.Tag
+		}
+	}
+	cfg.Outbounds = append(cfg.Outbounds, &vc.Outbound{Protocol: "blackhole", Tag: blockTag})
+	return blockTag
+}
+
+// countryTags selects endpoints by their detected exit country rather than by
+// what their tags claim.
+func countryTags(eps []sub.Endpoint, country string) []string {
+	healthMux.Lock()
+	defer healthMux.Unlock()
+	var tags []string
+	for _, ep := range eps {
+		if h, found := healths[ep.Share()]; found && strings.EqualFold(h.country, country) {
+			tags = append(tags, ep.Tag())
+		}
+	}
+	return tags
+}
@@ -0,0 +1,103 @@
+package check
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"testing"
+	"vc/sub"
+)
+
+type stubProbe struct {
+	name string
+	ok   bool
+}
+
+func (p *stubProbe) Name() string {
+	return p.name
+}
+
+func (p *stubProbe) Probe(_ context.Context, _ sub.Endpoint) error {
+	if p.ok {
+		return nil
+	}
+	return errors.Errorf("%s failed", p.name)
+}
+
+// stubGroup builds a probe group of kind with a probe for each result.
+func stubGroup(kind string, results ...bool) ProbeGroup {
+	group := ProbeGroup{Kind: kind}
+	for _, ok := range results {
+		group.Probes = append(group.Probes, &stubProbe{name: kind, ok: ok})
+	}
+	return group
+}
+
+func TestCheckQuorumPerKind(t *testing.T) {
+	saved, savedQuorum := probes, quorum
+	t.Cleanup(func() {
+		probes, quorum = saved, savedQuorum
+	})
+	tests := []struct {
+		name   string
+		quorum string
+		groups []ProbeGroup
+		want   bool
+	}{
+		{
+			name:   "all passed",
+			quorum: QuorumAll,
+			groups: []ProbeGroup{stubGroup("http", true, true), stubGroup("dns", true)},
+			want:   true,
+		},
+		{
+			name:   "all with one failed",
+			quorum: QuorumAll,
+			groups: []ProbeGroup{stubGroup("http", true, false), stubGroup("dns", true)},
+			want:   false,
+		},
+		{
+			name:   "any in every kind",
+			quorum: QuorumAny,
+			groups: []ProbeGroup{stubGroup("http", false, true), stubGroup("tcp", true, false)},
+			want:   true,
+		},
+		{
+			name:   "passing http cannot outvote failing dns",
+			quorum: QuorumMajority,
+			groups: []ProbeGroup{stubGroup("http", true, true, true, true), stubGroup("dns", false)},
+			want:   false,
+		},
+		{
+			name:   "majority in every kind",
+			quorum: QuorumMajority,
+			groups: []ProbeGroup{stubGroup("http", true, true, false), stubGroup("dns", true)},
+			want:   true,
+		},
+		{
+			name:   "half is no majority",
+			quorum: QuorumMajority,
+			groups: []ProbeGroup{stubGroup("http", true, false)},
+			want:   false,
+		},
+	}
+	ep, err := sub.FromShareUrl("vless://id@example.com:443#ep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probes, quorum = tt.groups, tt.quorum
+			r := check(context.Background(), ep)
+			if r.ok != tt.want {
+				t.Errorf("check() ok = %v, want %v", r.ok, tt.want)
+			}
+			total := 0
+			for _, group := range tt.groups {
+				total += len(group.Probes)
+			}
+			if len(r.targets) != total {
+				t.Errorf("check() got %d target results, want %d", len(r.targets), total)
+			}
+		})
+	}
+}
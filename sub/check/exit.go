@@ -0,0 +1,85 @@
+package check
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"vc/sub"
+)
+
+// blockTag is the blackhole outbound added for country balancers that have
+// no endpoint left when the config has none.
+const blockTag = "block"
+
+var (
+	exitIpUrl            = ""
+	countryBalancePrefix = "country-"
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_EXIT_IP_URL"); ok && s != "" {
+		if _, err := url.Parse(s); err != nil {
+			slog.Info(fmt.Sprintf("Invalid exit ip url: %q, exit ip detection disabled", s))
+		} else {
+			exitIpUrl = s
+		}
+	}
+	if s, ok := os.LookupEnv("VC_COUNTRY_BALANCER_PREFIX"); ok && s != "" {
+		countryBalancePrefix = s
+	}
+}
+
+// exitIp fetches the egress address of the endpoint from the ip echo service.
+// Both plain text responses and json ones with an "ip" or "origin" field,
+// like httpbin.org/ip, are accepted.
+func exitIp(ctx context.Context, ep sub.Endpoint) (string, error) {
+	tr := &http.Transport{
+		Proxy: func(_ *http.Request) (*url.URL, error) {
+			return url.Parse(fmt.Sprintf("socks5://127.0.0.1:%d", ep.CheckPort()))
+		},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, exitIpUrl, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "building request failed")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", errors.Wrap(err, "reading response body failed")
+	}
+	ip := strings.TrimSpace(string(body))
+	echo := struct {
+		Ip     string `json:"ip"`
+		Origin string `json:"origin"`
+	}{}
+	if json.Unmarshal(body, &echo) == nil {
+		ip = echo.Ip
+		if ip == "" {
+			ip, _ = divideStr(echo.Origin, ",")
+		}
+		ip = strings.TrimSpace(ip)
+	}
+	if net.ParseIP(ip) == nil {
+		return "", errors.Errorf("invalid ip echo response: %q", string(body))
+	}
+	return ip, nil
+}
@@ -0,0 +1,84 @@
+package check
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"os"
+	"vc/vc"
+)
+
+const (
+	AllDownKeep     = "keep"
+	AllDownAll      = "all"
+	AllDownFallback = "fallback"
+)
+
+var (
+	allDownPolicy = AllDownKeep
+	fallbackTag   = "direct"
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_ALL_DOWN_POLICY"); ok {
+		switch s {
+		case AllDownKeep, AllDownAll, AllDownFallback:
+			allDownPolicy = s
+		default:
+			slog.Info(fmt.Sprintf("Invalid all-down policy: %q, use default value: %q", s, allDownPolicy))
+		}
+	}
+	if s, ok := os.LookupEnv("VC_ALL_DOWN_FALLBACK"); ok && s != "" {
+		fallbackTag = s
+	}
+}
+
+func AllDownPolicy() string {
+	return allDownPolicy
+}
+
+func FallbackTag() string {
+	return fallbackTag
+}
+
+// ValidateFallback returns an error if the all-down policy routes to a
+// fallback outbound that cfg does not have.
+func ValidateFallback(cfg *vc.Config) error {
+	if allDownPolicy != AllDownFallback {
+		return nil
+	}
+	for _, outbound := range cfg.Outbounds {
+		if outbound.Tag == fallbackTag {
+			return nil
+		}
+	}
+	return errors.Errorf("all-down fallback outbound %q not found", fallbackTag)
+}
+
+// Fallback routes every balancer to the configured fallback outbound, used
+// when every endpoint fails the check.
+func Fallback(cfg *vc.Config) (*vc.Config, error) {
+	if err := ValidateFallback(cfg); err != nil {
+		return nil, err
+	}
+	cfg, err := vc.DeepClone(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range cfg.Routing.Balancers {
+		b.Selector = []string{fallbackTag}
+	}
+	return cfg, nil
+}
+
+// fallbackOutbound returns the fallback outbound if cfg has it, and a
+// blackhole outbound otherwise, so that traffic fails closed rather than
+// going out of an outbound nobody chose.
+func fallbackOutbound(cfg *vc.Config) string {
+	for _, outbound := range cfg.Outbounds {
+		if outbound.Tag == fallbackTag {
+			return fallbackTag
+		}
+	}
+	return blockOutbound(cfg)
+}
@@ -0,0 +1,44 @@
+package check
+
+import (
+	"testing"
+	"vc/vc"
+)
+
+func TestFallback(t *testing.T) {
+	policy, tag := allDownPolicy, fallbackTag
+	allDownPolicy, fallbackTag = AllDownFallback, "direct"
+	t.Cleanup(func() {
+		allDownPolicy, fallbackTag = policy, tag
+	})
+	cfg := &vc.Config{
+		Outbounds: []*vc.Outbound{{Tag: "a"}, {Tag: "b"}, {Tag: "direct", Protocol: "freedom"}},
+		Routing: &vc.Routing{Balancers: []*vc.Balancer{
+			{Tag: "main", Selector: []string{"a", "b"}},
+			{Tag: "country-US", Selector: []string{"b"}},
+		}},
+	}
+	fallback, err := Fallback(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range fallback.Routing.Balancers {
+		if len(b.Selector) != 1 || b.Selector[0] != "direct" {
+			t.Errorf("balancer %s selects %v, want [direct]", b.Tag, b.Selector)
+		}
+	}
+	if len(cfg.Routing.Balancers[0].Selector) != 2 {
+		t.Errorf("Fallback() changed the original config")
+	}
+	fallbackTag = "missing"
+	if _, err := Fallback(cfg); err == nil {
+		t.Errorf("Fallback() to a missing outbound succeeded")
+	}
+	if err := ValidateFallback(cfg); err == nil {
+		t.Errorf("ValidateFallback() of a missing outbound succeeded")
+	}
+	allDownPolicy = AllDownKeep
+	if err := ValidateFallback(cfg); err != nil {
+		t.Errorf("ValidateFallback() with policy keep = %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package check
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"vc/protowire"
+)
+
+// geoDB resolves IPs to ISO country codes.
+type geoDB interface {
+	country(ip net.IP) string
+}
+
+var (
+	geoMux = &sync.RWMutex{}
+	geo    geoDB
+)
+
+// LoadGeoIP loads a country database, either a v2ray geoip.dat file or a
+// MaxMind DB file like GeoLite2-Country.mmdb, so that exit IPs can be resolved
+// to countries. Non-country lists of geoip.dat such as "private" are skipped.
+func LoadGeoIP(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return errors.Wrap(err, "reading geoip file failed")
+	}
+	var db geoDB
+	if bytes.LastIndex(data, mmdbMetadataMarker) >= 0 {
+		db, err = parseMMDB(data)
+		if err != nil {
+			return errors.Wrap(err, "parsing mmdb file failed")
+		}
+	} else {
+		var cidrs []cidr
+		err = protowire.Walk(data, func(field int, value []byte) error {
+			if field != 1 {
+				return nil
+			}
+			entry, err := parseGeoIP(value)
+			if err != nil {
+				return err
+			}
+			cidrs = append(cidrs, entry...)
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "parsing geoip file failed")
+		}
+		db = newGeoRanges(cidrs)
+	}
+	geoMux.Lock()
+	geo = db
+	geoMux.Unlock()
+	return nil
+}
+
+type cidr struct {
+	ip      []byte
+	prefix  int
+	country string
+}
+
+func parseGeoIP(data []byte) ([]cidr, error) {
+	var (
+		country string
+		reverse bool
+		cidrs   []cidr
+	)
+	err := protowire.Walk(data, func(field int, value []byte) error {
+		switch field {
+		case 1:
+			country = strings.ToUpper(string(value))
+		case 2:
+			c := cidr{}
+			err := protowire.Walk(value, func(field int, value []byte) error {
+				switch field {
+				case 1:
+					c.ip = value
+				case 2:
+					p, _ := protowire.ReadVarint(value)
+					c.prefix = int(p)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			cidrs = append(cidrs, c)
+		case 3:
+			v, _ := protowire.ReadVarint(value)
+			reverse = v != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reverse || len(country) != 2 {
+		return nil, nil
+	}
+	for i := range cidrs {
+		cidrs[i].country = country
+	}
+	return cidrs, nil
+}
+
+// addr is an IPv6 address, or an IPv4 one mapped into IPv6, as two halves
+// that compare as numbers.
+type addr struct {
+	hi, lo uint64
+}
+
+func addrOf(ip net.IP) addr {
+	ip16 := ip.To16()
+	return addr{binary.BigEndian.Uint64(ip16[:8]), binary.BigEndian.Uint64(ip16[8:])}
+}
+
+func (a addr) less(b addr) bool {
+	return a.hi < b.hi || a.hi == b.hi && a.lo < b.lo
+}
+
+// next returns the address after a, and false if a is the last one.
+func (a addr) next() (addr, bool) {
+	if a.lo != ^uint64(0) {
+		return addr{a.hi, a.lo + 1}, true
+	}
+	if a.hi != ^uint64(0) {
+		return addr{a.hi + 1, 0}, true
+	}
+	return a, false
+}
+
+// prev returns the address before a, a must not be the first one.
+func (a addr) prev() addr {
+	if a.lo != 0 {
+		return addr{a.hi, a.lo - 1}
+	}
+	return addr{a.hi - 1, ^uint64(0)}
+}
+
+type geoRange struct {
+	start, end addr
+	country    string
+}
+
+// geoRanges are disjoint ranges sorted by address, to be binary-searched.
+type geoRanges []geoRange
+
+// newGeoRanges turns CIDRs into disjoint ranges. CIDRs are either disjoint or
+// nested, and a nested one takes its part out of the one around it, so the
+// most specific CIDR decides.
+func newGeoRanges(cidrs []cidr) geoRanges {
+	var all []geoRange
+	for _, c := range cidrs {
+		prefix := c.prefix
+		switch {
+		case len(c.ip) == net.IPv4len && prefix <= 32:
+			prefix += 96
+		case len(c.ip) == net.IPv6len && prefix <= 128:
+		default:
+			continue
+		}
+		start := addrOf(net.IP(c.ip).Mask(net.CIDRMask(c.prefix, len(c.ip)*8)))
+		end := start
+		// set the host bits
+		if bits := 128 - prefix; bits >= 64 {
+			end.lo = ^uint64(0)
+			end.hi |= uint64(1)<<(bits-64) - 1
+		} else {
+			end.lo |= uint64(1)<<bits - 1
+		}
+		all = append(all, geoRange{start: start, end: end, country: c.country})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].start != all[j].start {
+			return all[i].start.less(all[j].start)
+		}
+		return all[j].end.less(all[i].end)
+	})
+	var (
+		ranges geoRanges
+		open   []geoRange
+		pos    addr
+		done   bool
+	)
+	emit := func(end addr, country string) {
+		if !done && !end.less(pos) {
+			ranges = append(ranges, geoRange{start: pos, end: end, country: country})
+		}
+	}
+	closeTop := func() {
+		top := open[len(open)-1]
+		open = open[:len(open)-1]
+		emit(top.end, top.country)
+		if !top.end.less(pos) {
+			var ok bool
+			pos, ok = top.end.next()
+			done = done || !ok
+		}
+	}
+	for _, r := range all {
+		for len(open) > 0 && open[len(open)-1].end.less(r.start) {
+			closeTop()
+		}
+		if len(open) > 0 && pos.less(r.start) {
+			emit(r.start.prev(), open[len(open)-1].country)
+		}
+		open = append(open, r)
+		pos, done = r.start, false
+	}
+	for len(open) > 0 {
+		closeTop()
+	}
+	return ranges
+}
+
+func (r geoRanges) country(ip net.IP) string {
+	a := addrOf(ip)
+	i := sort.Search(len(r), func(i int) bool {
+		return !r[i].end.less(a)
+	})
+	if i < len(r) && !a.less(r[i].start) {
+		return r[i].country
+	}
+	return ""
+}
+
+// Country returns the ISO country code of ip, or "" if unknown.
+func Country(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	geoMux.RLock()
+	defer geoMux.RUnlock()
+	if geo == nil {
+		return ""
+	}
+	return geo.country(parsed)
+}
@@ -0,0 +1,309 @@
+package check
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"vc/protowire"
+)
+
+// geoIPEntry encodes a GeoIP{country_code = 1, repeated CIDR cidr = 2,
+// reverse_match = 3} message, with CIDR{ip = 1, prefix = 2}.
+func geoIPEntry(country string, reverse bool, cidrs ...string) []byte {
+	entry := protowire.AppendBytesField(nil, 1, []byte(country))
+	for _, s := range cidrs {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		ip := ipNet.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		prefix, _ := ipNet.Mask.Size()
+		c := protowire.AppendVarintField(protowire.AppendBytesField(nil, 1, ip), 2, uint64(prefix))
+		entry = protowire.AppendBytesField(entry, 2, c)
+	}
+	if reverse {
+		entry = protowire.AppendVarintField(entry, 3, 1)
+	}
+	return entry
+}
+
+func TestParseGeoIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		country string
+		wantErr bool
+	}{
+		{name: "country", data: geoIPEntry("us", false, "8.8.8.0/24", "2001:4860::/32"), want: 2, country: "US"},
+		{name: "non-country list", data: geoIPEntry("private", false, "10.0.0.0/8"), want: 0},
+		{name: "reverse match", data: geoIPEntry("cn", true, "1.0.1.0/24"), want: 0},
+		{name: "unknown field", data: protowire.AppendVarintField(geoIPEntry("jp", false, "1.0.16.0/20"), 9, 1), want: 1, country: "JP"},
+		{name: "truncated", data: geoIPEntry("de", false, "5.1.0.0/16")[:6], wantErr: true},
+		{name: "unsupported wire type", data: []byte{0x0b}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cidrs, err := parseGeoIP(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGeoIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(cidrs) != tt.want {
+				t.Fatalf("parseGeoIP() got %d cidrs, want %d", len(cidrs), tt.want)
+			}
+			for _, c := range cidrs {
+				if c.country != tt.country {
+					t.Errorf("country = %q, want %q", c.country, tt.country)
+				}
+			}
+		})
+	}
+}
+
+func TestCountry(t *testing.T) {
+	var data []byte
+	data = protowire.AppendBytesField(data, 1, geoIPEntry("private", false, "10.0.0.0/8"))
+	data = protowire.AppendBytesField(data, 1, geoIPEntry("us", false, "8.8.8.0/24", "2001:4860::/32"))
+	data = protowire.AppendBytesField(data, 1, geoIPEntry("jp", false, "1.0.16.0/20"))
+	filename := filepath.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadGeoIP(filename); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		geoMux.Lock()
+		geo = nil
+		geoMux.Unlock()
+	})
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "8.8.8.8", want: "US"},
+		{ip: "::ffff:8.8.8.8", want: "US"},
+		{ip: "2001:4860:4860::8888", want: "US"},
+		{ip: "1.0.31.255", want: "JP"},
+		{ip: "1.0.32.0", want: ""},
+		{ip: "10.1.2.3", want: ""},
+		{ip: "not an ip", want: ""},
+	}
+	for _, tt := range tests {
+		if got := Country(tt.ip); got != tt.want {
+			t.Errorf("Country(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestGeoRangesNested(t *testing.T) {
+	newCidr := func(s string, country string) cidr {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipNet.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		prefix, _ := ipNet.Mask.Size()
+		return cidr{ip: ip, prefix: prefix, country: country}
+	}
+	ranges := newGeoRanges([]cidr{
+		newCidr("10.1.0.0/16", "BB"),
+		newCidr("10.0.0.0/8", "AA"),
+		newCidr("10.0.0.0/24", "CC"),
+		newCidr("10.1.2.0/24", "DD"),
+		newCidr("255.255.255.0/24", "EE"),
+		newCidr("::/0", "FF"),
+		newCidr("2001:db8::/32", "GG"),
+	})
+	for i := 1; i < len(ranges); i++ {
+		if !ranges[i-1].end.less(ranges[i].start) {
+			t.Fatalf("ranges %d and %d overlap", i-1, i)
+		}
+	}
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "10.0.0.1", want: "CC"},
+		{ip: "10.0.1.0", want: "AA"},
+		{ip: "10.1.0.0", want: "BB"},
+		{ip: "10.1.2.3", want: "DD"},
+		{ip: "10.1.3.0", want: "BB"},
+		{ip: "10.2.0.1", want: "AA"},
+		{ip: "10.255.255.255", want: "AA"},
+		{ip: "11.0.0.0", want: "FF"},
+		{ip: "255.255.255.255", want: "EE"},
+		{ip: "2001:db8::1", want: "GG"},
+		{ip: "2001:db9::1", want: "FF"},
+		{ip: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", want: "FF"},
+	}
+	for _, tt := range tests {
+		if got := ranges.country(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("country(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// mmdbValue encodes a string, a uint32 or a map of them in the MaxMind DB
+// data format.
+func mmdbValue(v any) []byte {
+	control := func(typ int, size int) []byte {
+		if typ > 7 {
+			return []byte{byte(size), byte(typ - 7)}
+		}
+		return []byte{byte(typ<<5 | size)}
+	}
+	switch v := v.(type) {
+	case string:
+		return append(control(mmdbString, len(v)), v...)
+	case int:
+		b := binary.BigEndian.AppendUint32(nil, uint32(v))
+		return append(control(mmdbUint32, 4), b...)
+	case map[string]any:
+		b := control(mmdbMap, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = append(b, mmdbValue(k)...)
+			b = append(b, mmdbValue(v[k])...)
+		}
+		return b
+	}
+	panic(fmt.Sprintf("unsupported value %v", v))
+}
+
+// buildMMDB builds a database with 24 bit records of the IPv4 networks in
+// countries, in an IPv6 tree if ipv6 is true.
+func buildMMDB(countries map[string]string, ipv6 bool) []byte {
+	type node struct {
+		children [2]*node
+		country  string
+	}
+	root := &node{}
+	for s, country := range countries {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		bits := []byte(ipNet.IP.To4())
+		prefix, _ := ipNet.Mask.Size()
+		if ipv6 {
+			bits, prefix = append(make([]byte, 12), bits...), prefix+96
+		}
+		n := root
+		for i := 0; i < prefix; i++ {
+			bit := bits[i/8] >> (7 - i%8) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &node{}
+			}
+			n = n.children[bit]
+		}
+		n.country = country
+	}
+	// number the inner nodes breadth first, the root is node 0
+	var nodes []*node
+	ids := map[*node]int{}
+	for queue := []*node{root}; len(queue) > 0; queue = queue[1:] {
+		n := queue[0]
+		ids[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil && c.country == "" {
+				queue = append(queue, c)
+			}
+		}
+	}
+	var data []byte
+	offsets := map[string]int{}
+	for _, country := range countries {
+		if _, found := offsets[country]; !found {
+			offsets[country] = len(data)
+			data = append(data, mmdbValue(map[string]any{"country": map[string]any{"iso_code": country}})...)
+		}
+	}
+	var tree []byte
+	for _, n := range nodes {
+		for _, c := range n.children {
+			record := len(nodes)
+			if c != nil && c.country != "" {
+				record = len(nodes) + 16 + offsets[c.country]
+			} else if c != nil {
+				record = ids[c]
+			}
+			tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	version := 4
+	if ipv6 {
+		version = 6
+	}
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	return append(file, mmdbValue(map[string]any{
+		"node_count":  len(nodes),
+		"record_size": 24,
+		"ip_version":  version,
+	})...)
+}
+
+func TestMMDB(t *testing.T) {
+	countries := map[string]string{
+		"8.8.8.0/24":  "us",
+		"1.0.16.0/20": "JP",
+		"1.0.32.0/19": "CN",
+	}
+	for _, ipv6 := range []bool{false, true} {
+		db, err := parseMMDB(buildMMDB(countries, ipv6))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			ip   string
+			want string
+		}{
+			{ip: "8.8.8.8", want: "US"},
+			{ip: "1.0.31.255", want: "JP"},
+			{ip: "1.0.32.1", want: "CN"},
+			{ip: "1.0.64.1", want: ""},
+			{ip: "9.9.9.9", want: ""},
+			{ip: "2001:db8::1", want: ""},
+		}
+		for _, tt := range tests {
+			if got := db.country(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("ipv6 tree %v: country(%s) = %q, want %q", ipv6, tt.ip, got, tt.want)
+			}
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(filename, buildMMDB(countries, true), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadGeoIP(filename); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		geoMux.Lock()
+		geo = nil
+		geoMux.Unlock()
+	})
+	if got := Country("1.0.16.1"); got != "JP" {
+		t.Errorf("Country() = %q, want JP", got)
+	}
+	if _, err := parseMMDB(append([]byte{0}, mmdbMetadataMarker...)); err == nil {
+		t.Errorf("parseMMDB() of invalid metadata succeeded")
+	}
+}
@@ -0,0 +1,140 @@
+package check
+
+import (
+	"fmt"
+	"golang.org/x/exp/slog"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"vc/sub"
+)
+
+var (
+	failThreshold    = 3
+	successThreshold = 2
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_CHECK_FAIL_THRESHOLD"); ok {
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || i < 1 {
+			slog.Info(fmt.Sprintf("Invalid fail threshold: %q, use default value: %d", s, failThreshold))
+		} else {
+			failThreshold = int(i)
+		}
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_SUCCESS_THRESHOLD"); ok {
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || i < 1 {
+			slog.Info(fmt.Sprintf("Invalid success threshold: %q, use default value: %d", s, successThreshold))
+		} else {
+			successThreshold = int(i)
+		}
+	}
+}
+
+// health tracks consecutive check outcomes of an endpoint, so that a single
+// failure or success does not change balancer membership.
+type health struct {
+	tag       string
+	healthy   bool
+	failures  int
+	successes int
+	checkedAt time.Time
+	targets   []TargetResult
+	exitIp    string
+	country   string
+
+	throughput   float64
+	throughputAt time.Time
+}
+
+// record counts a check result, and reports whether the state changed. The
+// first check decides the state of a new endpoint, later ones change it only
+// past the thresholds.
+func (h *health) record(ok bool) bool {
+	if h.checkedAt.IsZero() {
+		h.healthy = ok
+	}
+	if ok {
+		h.successes++
+		h.failures = 0
+		if !h.healthy && h.successes >= successThreshold {
+			h.healthy = true
+			return true
+		}
+		return false
+	}
+	h.failures++
+	h.successes = 0
+	if h.healthy && h.failures >= failThreshold {
+		h.healthy = false
+		return true
+	}
+	return false
+}
+
+var (
+	healthMux = &sync.Mutex{}
+	healths   = map[string]*health{}
+)
+
+// Available leaves out the endpoints the check has marked down, endpoints not
+// checked yet are kept.
+func Available(eps []sub.Endpoint) []sub.Endpoint {
+	healthMux.Lock()
+	defer healthMux.Unlock()
+	available := make([]sub.Endpoint, 0, len(eps))
+	for _, ep := range eps {
+		if h, found := healths[ep.Share()]; found && !h.checkedAt.IsZero() && !h.healthy {
+			continue
+		}
+		available = append(available, ep)
+	}
+	return available
+}
+
+type Report struct {
+	Tag       string         `json:"tag"`
+	Healthy   bool           `json:"healthy"`
+	Failures  int            `json:"consecutiveFailures"`
+	Successes int            `json:"consecutiveSuccesses"`
+	CheckedAt time.Time      `json:"checkedAt"`
+	Targets   []TargetResult `json:"targets"`
+	ExitIp    string         `json:"exitIp,omitempty"`
+	Country   string         `json:"country,omitempty"`
+
+	ThroughputMbps float64    `json:"throughputMbps,omitempty"`
+	ThroughputAt   *time.Time `json:"throughputAt,omitempty"`
+}
+
+// Reports returns the latest check result of every endpoint, ordered by tag.
+func Reports() []Report {
+	healthMux.Lock()
+	defer healthMux.Unlock()
+	reports := make([]Report, 0, len(healths))
+	for _, h := range healths {
+		report := Report{
+			Tag:            h.tag,
+			Healthy:        h.healthy,
+			Failures:       h.failures,
+			Successes:      h.successes,
+			CheckedAt:      h.checkedAt,
+			Targets:        h.targets,
+			ExitIp:         h.exitIp,
+			Country:        h.country,
+			ThroughputMbps: h.throughput,
+		}
+		if !h.throughputAt.IsZero() {
+			at := h.throughputAt
+			report.ThroughputAt = &at
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Tag < reports[j].Tag
+	})
+	return reports
+}
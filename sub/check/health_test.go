@@ -0,0 +1,65 @@
+package check
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthRecord(t *testing.T) {
+	fail, success := failThreshold, successThreshold
+	failThreshold, successThreshold = 3, 2
+	t.Cleanup(func() {
+		failThreshold, successThreshold = fail, success
+	})
+	tests := []struct {
+		name    string
+		results []bool
+		// healthy is the state after each result
+		healthy []bool
+		changed []bool
+	}{
+		{
+			name:    "first success",
+			results: []bool{true},
+			healthy: []bool{true},
+			changed: []bool{false},
+		},
+		{
+			name:    "first failure",
+			results: []bool{false, false},
+			healthy: []bool{false, false},
+			changed: []bool{false, false},
+		},
+		{
+			name:    "blip is absorbed",
+			results: []bool{true, false, false, true, false},
+			healthy: []bool{true, true, true, true, true},
+			changed: []bool{false, false, false, false, false},
+		},
+		{
+			name:    "marked down past the fail threshold",
+			results: []bool{true, false, false, false, false},
+			healthy: []bool{true, true, true, false, false},
+			changed: []bool{false, false, false, true, false},
+		},
+		{
+			name:    "recovers past the success threshold",
+			results: []bool{false, true, false, true, true},
+			healthy: []bool{false, false, false, false, true},
+			changed: []bool{false, false, false, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &health{}
+			for i, ok := range tt.results {
+				changed := h.record(ok)
+				h.checkedAt = time.Now()
+				if h.healthy != tt.healthy[i] || changed != tt.changed[i] {
+					t.Fatalf("after result %d: healthy = %v, changed = %v, want %v, %v",
+						i, h.healthy, changed, tt.healthy[i], tt.changed[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package check
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vc/sub"
+)
+
+var (
+	historySize      = 1440
+	historyRetention = time.Hour * 24 * 7
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_CHECK_HISTORY_SIZE"); ok {
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || i < 1 {
+			slog.Info(fmt.Sprintf("Invalid history size: %q, use default value: %d", s, historySize))
+		} else {
+			historySize = int(i)
+		}
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_HISTORY_RETENTION"); ok {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || i < 1 {
+			slog.Info(fmt.Sprintf("Invalid history retention: %q, use default value: %d", s, int64(historyRetention.Seconds())))
+		} else {
+			historyRetention = time.Second * time.Duration(i)
+		}
+	}
+}
+
+type Record struct {
+	At         time.Time `json:"at"`
+	Ok         bool      `json:"ok"`
+	LatencyMs  int64     `json:"latencyMs,omitempty"`
+	ErrorClass string    `json:"errorClass,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// history is a ring buffer of the latest historySize check records of an
+// endpoint, keyed by its share url like its health.
+type history struct {
+	tag     string
+	records []Record
+	start   int
+}
+
+func (h *history) add(r Record) {
+	if len(h.records) < historySize {
+		h.records = append(h.records, r)
+		return
+	}
+	h.records[h.start] = r
+	h.start = (h.start + 1) % len(h.records)
+}
+
+// last returns when the endpoint was last checked.
+func (h *history) last() time.Time {
+	if len(h.records) == 0 {
+		return time.Time{}
+	}
+	return h.records[(h.start+len(h.records)-1)%len(h.records)].At
+}
+
+func (h *history) list() []Record {
+	records := make([]Record, 0, len(h.records))
+	records = append(records, h.records[h.start:]...)
+	return append(records, h.records[:h.start]...)
+}
+
+var (
+	historyMux = &sync.Mutex{}
+	histories  = map[string]*history{}
+)
+
+// recordHistory adds the check records of endpoints, keyed by share url. The
+// history of an endpoint missing from a check is kept, so that it survives a
+// subscription fetch without it, until it has not been checked for
+// VC_CHECK_HISTORY_RETENTION.
+func recordHistory(eps []sub.Endpoint, records map[string]Record) {
+	historyMux.Lock()
+	defer historyMux.Unlock()
+	expireHistory(time.Now())
+	for _, ep := range eps {
+		h, found := histories[ep.Share()]
+		if !found {
+			h = &history{}
+			histories[ep.Share()] = h
+		}
+		h.tag = ep.Tag()
+		h.add(records[ep.Share()])
+	}
+}
+
+// expireHistory drops the history of endpoints last checked historyRetention
+// before now. historyMux should be held.
+func expireHistory(now time.Time) {
+	for share, h := range histories {
+		if now.Sub(h.last()) > historyRetention {
+			delete(histories, share)
+		}
+	}
+}
+
+func newRecord(at time.Time, r result) Record {
+	record := Record{At: at, Ok: r.ok}
+	var total, n int64
+	for _, t := range r.targets {
+		if t.Ok {
+			total += t.LatencyMs
+			n++
+		} else if record.Error == "" {
+			record.Error = t.Error
+			record.ErrorClass = t.ErrorClass
+		}
+	}
+	if n > 0 {
+		record.LatencyMs = total / n
+	}
+	if record.Ok {
+		record.Error, record.ErrorClass = "", ""
+	}
+	return record
+}
+
+func classifyError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection refused"):
+		return "refused"
+	case strings.Contains(msg, "socks"):
+		return "proxy"
+	case strings.Contains(msg, "no such host"), strings.Contains(msg, "resolving"):
+		return "dns"
+	case strings.Contains(msg, "tls"), strings.Contains(msg, "x509"):
+		return "tls"
+	case strings.Contains(msg, "unexpected status"), strings.Contains(msg, "response body"):
+		return "response"
+	default:
+		return "other"
+	}
+}
+
+type Stat struct {
+	Tag           string     `json:"tag"`
+	Checks        int        `json:"checks"`
+	Uptime        float64    `json:"uptime"`
+	MeanLatencyMs int64      `json:"meanLatencyMs"`
+	P95LatencyMs  int64      `json:"p95LatencyMs"`
+	LastFailureAt *time.Time `json:"lastFailureAt,omitempty"`
+	LastFailure   string     `json:"lastFailure,omitempty"`
+}
+
+func (h *history) stat() Stat {
+	s := Stat{Tag: h.tag, Checks: len(h.records)}
+	var (
+		ok        int
+		total     int64
+		latencies []int64
+	)
+	for _, r := range h.list() {
+		if !r.Ok {
+			at := r.At
+			s.LastFailureAt, s.LastFailure = &at, r.Error
+			continue
+		}
+		ok++
+		total += r.LatencyMs
+		latencies = append(latencies, r.LatencyMs)
+	}
+	if s.Checks > 0 {
+		s.Uptime = float64(ok) * 100 / float64(s.Checks)
+	}
+	if ok > 0 {
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		s.MeanLatencyMs = total / int64(ok)
+		s.P95LatencyMs = latencies[int(math.Ceil(float64(ok)*0.95))-1]
+	}
+	return s
+}
+
+// Stats summarizes the check history of every endpoint, ordered by tag.
+func Stats() []Stat {
+	historyMux.Lock()
+	defer historyMux.Unlock()
+	stats := make([]Stat, 0, len(histories))
+	for _, h := range histories {
+		stats = append(stats, h.stat())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Tag < stats[j].Tag
+	})
+	return stats
+}
+
+// History returns the check records of an endpoint, oldest first. Of
+// endpoints once known by the same tag, the one checked last is taken.
+func History(tag string) []Record {
+	historyMux.Lock()
+	defer historyMux.Unlock()
+	var latest *history
+	for _, h := range histories {
+		if h.tag == tag && (latest == nil || latest.last().Before(h.last())) {
+			latest = h
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return latest.list()
+}
+
+func historyStat(ep sub.Endpoint) (Stat, bool) {
+	historyMux.Lock()
+	defer historyMux.Unlock()
+	h, found := histories[ep.Share()]
+	if !found || len(h.records) == 0 {
+		return Stat{}, false
+	}
+	return h.stat(), true
+}
+
+type savedHistory struct {
+	Tag     string   `json:"tag"`
+	Share   string   `json:"share"`
+	Records []Record `json:"records"`
+}
+
+func LoadHistory(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "reading history file failed")
+	}
+	var saved []savedHistory
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return errors.Wrap(err, "decoding history file failed")
+	}
+	historyMux.Lock()
+	defer historyMux.Unlock()
+	histories = make(map[string]*history, len(saved))
+	for _, s := range saved {
+		h := &history{tag: s.Tag}
+		for _, r := range s.Records {
+			h.add(r)
+		}
+		histories[s.Share] = h
+	}
+	expireHistory(time.Now())
+	return nil
+}
+
+func SaveHistory(filename string) error {
+	historyMux.Lock()
+	saved := make([]savedHistory, 0, len(histories))
+	for share, h := range histories {
+		saved = append(saved, savedHistory{Tag: h.tag, Share: share, Records: h.list()})
+	}
+	historyMux.Unlock()
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].Tag < saved[j].Tag
+	})
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return errors.Wrap(err, "encoding history failed")
+	}
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "writing history file failed")
+	}
+	return errors.Wrap(os.Rename(tmp, filename), "replacing history file failed")
+}
@@ -0,0 +1,105 @@
+package check
+
+import (
+	"testing"
+	"time"
+	"vc/sub"
+)
+
+func TestHistoryStat(t *testing.T) {
+	size := historySize
+	historySize = 20
+	t.Cleanup(func() {
+		historySize = size
+	})
+	start := time.Now()
+	h := &history{tag: "ep"}
+	// the first records fall out of the ring buffer
+	for i := 0; i < 5; i++ {
+		h.add(Record{At: start, Ok: false, Error: "dropped"})
+	}
+	for i := 1; i <= 18; i++ {
+		h.add(Record{At: start.Add(time.Minute * time.Duration(i)), Ok: true, LatencyMs: int64(i * 10)})
+	}
+	failedAt := start.Add(time.Hour)
+	h.add(Record{At: failedAt, Ok: false, Error: "timeout"})
+	h.add(Record{At: failedAt.Add(time.Minute), Ok: true, LatencyMs: 1000})
+	s := h.stat()
+	if s.Checks != 20 {
+		t.Errorf("Checks = %d, want 20", s.Checks)
+	}
+	// 19 of the 20 records left after the ring buffer wrapped passed:
+	// 10..180ms and 1000ms
+	if s.Uptime != 95 {
+		t.Errorf("Uptime = %v, want 95", s.Uptime)
+	}
+	var total int64
+	for i := 1; i <= 18; i++ {
+		total += int64(i * 10)
+	}
+	if want := (total + 1000) / 19; s.MeanLatencyMs != want {
+		t.Errorf("MeanLatencyMs = %d, want %d", s.MeanLatencyMs, want)
+	}
+	// the 95th percentile of 19 latencies is the 19th, ceil(18.05)
+	if s.P95LatencyMs != 1000 {
+		t.Errorf("P95LatencyMs = %d, want 1000", s.P95LatencyMs)
+	}
+	if s.LastFailureAt == nil || !s.LastFailureAt.Equal(failedAt) || s.LastFailure != "timeout" {
+		t.Errorf("last failure = %v %q, want %v timeout", s.LastFailureAt, s.LastFailure, failedAt)
+	}
+}
+
+func TestHistoryP95(t *testing.T) {
+	tests := []struct {
+		latencies []int64
+		want      int64
+	}{
+		{latencies: []int64{42}, want: 42},
+		{latencies: []int64{30, 10, 20}, want: 30},
+		{latencies: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 100}, want: 19},
+	}
+	for _, tt := range tests {
+		h := &history{}
+		for _, l := range tt.latencies {
+			h.add(Record{Ok: true, LatencyMs: l})
+		}
+		h.add(Record{Ok: false})
+		if got := h.stat().P95LatencyMs; got != tt.want {
+			t.Errorf("p95 of %v = %d, want %d", tt.latencies, got, tt.want)
+		}
+	}
+}
+
+func TestRecordHistoryRetention(t *testing.T) {
+	saved := histories
+	t.Cleanup(func() {
+		histories = saved
+	})
+	histories = map[string]*history{}
+	a, err := sub.FromShareUrl("vless://id@a.example.com:443#a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sub.FromShareUrl("vless://id@b.example.com:443#b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	recordHistory([]sub.Endpoint{a, b}, map[string]Record{
+		a.Share(): {At: now, Ok: true},
+		b.Share(): {At: now.Add(-historyRetention - time.Minute), Ok: true},
+	})
+	if len(histories) != 2 {
+		t.Fatalf("got %d histories, want 2", len(histories))
+	}
+	// b is missing from the next check, and was last checked too long ago
+	recordHistory([]sub.Endpoint{a}, map[string]Record{a.Share(): {At: now, Ok: true}})
+	if _, found := histories[b.Share()]; found {
+		t.Errorf("history of b is kept past the retention")
+	}
+	// a is missing from one check, its history stays
+	recordHistory(nil, nil)
+	if records := History("a"); len(records) != 2 {
+		t.Errorf("history of a has %d records, want 2", len(records))
+	}
+}
@@ -0,0 +1,273 @@
+package check
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"math"
+	"net"
+	"strings"
+)
+
+// The MaxMind DB format is a binary search tree over the bits of addresses,
+// whose leaves point into a data section of typed values.
+// See https://maxmind.github.io/MaxMind-DB/ for the specification.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize int
+	ipVersion  int
+}
+
+func parseMMDB(file []byte) (*mmdb, error) {
+	i := bytes.LastIndex(file, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.Errorf("metadata not found")
+	}
+	metaData := file[i+len(mmdbMetadataMarker):]
+	value, _, err := (&mmdbDecoder{data: metaData}).decode(0, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding metadata failed")
+	}
+	meta, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.Errorf("metadata is not a map")
+	}
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, errors.Errorf("unsupported record size %d", recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, errors.Errorf("unsupported ip version %d", ipVersion)
+	}
+	treeSize := nodeCount * recordSize / 4
+	// the tree is followed by 16 zero bytes before the data section
+	if treeSize+16 > uint64(i) {
+		return nil, errors.Errorf("search tree of %d nodes exceeds the file", nodeCount)
+	}
+	return &mmdb{
+		tree:       file[:treeSize],
+		data:       file[treeSize+16 : i],
+		nodeCount:  nodeCount,
+		recordSize: int(recordSize),
+		ipVersion:  int(ipVersion),
+	}, nil
+}
+
+// record returns the left or right record of a node.
+func (db *mmdb) record(node uint64, right bool) uint64 {
+	b := db.tree[node*uint64(db.recordSize)/4:]
+	switch db.recordSize {
+	case 24:
+		if right {
+			b = b[3:]
+		}
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		if right {
+			return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+		}
+		return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	default:
+		if right {
+			b = b[4:]
+		}
+		return uint64(binary.BigEndian.Uint32(b))
+	}
+}
+
+// lookup returns the data record of ip, or nil if there is none.
+func (db *mmdb) lookup(ip net.IP) (any, error) {
+	var bits []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if db.ipVersion == 6 {
+			// IPv4 addresses are at ::a.b.c.d of IPv6 trees
+			bits = append(make([]byte, 12), ip4...)
+		}
+	} else if db.ipVersion == 6 {
+		bits = ip.To16()
+	} else {
+		return nil, nil
+	}
+	node := uint64(0)
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, bits[i/8]&(0x80>>(i%8)) != 0)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint64(len(db.data)) {
+		return nil, errors.Errorf("invalid data pointer %d", node)
+	}
+	value, _, err := (&mmdbDecoder{data: db.data}).decode(int(offset), 0)
+	return value, err
+}
+
+func (db *mmdb) country(ip net.IP) string {
+	value, err := db.lookup(ip)
+	if err != nil {
+		return ""
+	}
+	record, _ := value.(map[string]any)
+	// the registered country stands in when the located one is unknown
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := record[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok && code != "" {
+				return strings.ToUpper(code)
+			}
+		}
+	}
+	return ""
+}
+
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+type mmdbDecoder struct {
+	data []byte
+}
+
+func (d *mmdbDecoder) bytes(offset, n int) ([]byte, error) {
+	if n < 0 || offset+n > len(d.data) {
+		return nil, errors.Errorf("value at %d exceeds the data section", offset)
+	}
+	return d.data[offset : offset+n], nil
+}
+
+func (d *mmdbDecoder) uint(offset, n int) (uint64, error) {
+	b, err := d.bytes(offset, n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// decode decodes the value at offset, and returns the offset after it.
+// Maps, arrays and pointers nest at most depth 32.
+func (d *mmdbDecoder) decode(offset int, depth int) (any, int, error) {
+	if depth > 32 {
+		return nil, 0, errors.Errorf("values nested too deep")
+	}
+	ctrl, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	typ := int(ctrl[0] >> 5)
+	if typ == mmdbPointer {
+		ss, vvv := int(ctrl[0]>>3)&3, uint64(ctrl[0]&7)
+		p, err := d.uint(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch ss {
+		case 0:
+			p |= vvv << 8
+		case 1:
+			p = p | vvv<<16 + 2048
+		case 2:
+			p = p | vvv<<24 + 526336
+		}
+		value, _, err := d.decode(int(p), depth+1)
+		return value, offset + ss + 1, err
+	}
+	if typ == mmdbExtended {
+		ext, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		typ = 7 + int(ext[0])
+	}
+	size := int(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		extra, err := d.uint(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		size = []int{29, 285, 65821}[n-1] + int(extra)
+	}
+	if (typ == mmdbMap || typ == mmdbArray) && size > len(d.data) {
+		return nil, 0, errors.Errorf("%d items at %d exceed the data section", size, offset)
+	}
+	switch typ {
+	case mmdbString:
+		b, err := d.bytes(offset, size)
+		return string(b), offset + size, err
+	case mmdbBytes, mmdbUint128:
+		b, err := d.bytes(offset, size)
+		return b, offset + size, err
+	case mmdbDouble, mmdbFloat:
+		v, err := d.uint(offset, size)
+		if size == 4 {
+			return float64(math.Float32frombits(uint32(v))), offset + size, err
+		}
+		return math.Float64frombits(v), offset + size, err
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		v, err := d.uint(offset, size)
+		return v, offset + size, err
+	case mmdbInt32:
+		v, err := d.uint(offset, size)
+		return int64(int32(v)), offset + size, err
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.Errorf("map key at %d is not a string", offset)
+			}
+			m[k], offset, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, size)
+		for i := range a {
+			a[i], offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	default:
+		return nil, 0, errors.Errorf("unsupported data type %d at %d", typ, offset)
+	}
+}
@@ -0,0 +1,134 @@
+package check
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"vc/sub"
+	"vc/vc"
+)
+
+// Overrides are manual choices of endpoints that take precedence over the
+// check: pinned endpoints are the only ones the main balancer selects,
+// whatever their health, and excluded endpoints are never selected.
+type Overrides struct {
+	Pinned    []string   `json:"pinned,omitempty"`
+	Excluded  []string   `json:"excluded,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+var (
+	overrideMux = &sync.Mutex{}
+	overrides   = Overrides{}
+)
+
+func GetOverrides() Overrides {
+	overrideMux.Lock()
+	defer overrideMux.Unlock()
+	return overrides
+}
+
+func setOverrides(update func(o *Overrides)) {
+	overrideMux.Lock()
+	defer overrideMux.Unlock()
+	update(&overrides)
+	now := time.Now()
+	overrides.UpdatedAt = &now
+}
+
+// Pin makes the main balancer select only the endpoints of tags.
+func Pin(tags []string) {
+	setOverrides(func(o *Overrides) {
+		o.Pinned = sortedTags(tags)
+	})
+}
+
+// Exclude keeps the endpoints of tags out of every balancer.
+func Exclude(tags []string) {
+	setOverrides(func(o *Overrides) {
+		o.Excluded = sortedTags(tags)
+	})
+}
+
+func ClearOverrides() {
+	setOverrides(func(o *Overrides) {
+		o.Pinned, o.Excluded = nil, nil
+	})
+}
+
+func sortedTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	sorted := make([]string, len(tags))
+	copy(sorted, tags)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// HasOverrides tells whether any endpoint is pinned or excluded.
+func HasOverrides() bool {
+	o := GetOverrides()
+	return len(o.Pinned) > 0 || len(o.Excluded) > 0
+}
+
+// applyOverrides leaves excluded endpoints out of eps, and returns the pinned
+// tags that have an outbound in cfg, which replace eps in the main balancer.
+func applyOverrides(cfg *vc.Config, eps []sub.Endpoint) ([]sub.Endpoint, []string) {
+	o := GetOverrides()
+	excluded := make(map[string]bool, len(o.Excluded))
+	for _, tag := range o.Excluded {
+		excluded[tag] = true
+	}
+	kept := make([]sub.Endpoint, 0, len(eps))
+	for _, ep := range eps {
+		if !excluded[ep.Tag()] {
+			kept = append(kept, ep)
+		}
+	}
+	outbounds := make(map[string]bool, len(cfg.Outbounds))
+	for _, outbound := range cfg.Outbounds {
+		outbounds[outbound.Tag] = true
+	}
+	var pinned []string
+	for _, tag := range o.Pinned {
+		if outbounds[tag] && !excluded[tag] {
+			pinned = append(pinned, tag)
+		}
+	}
+	return kept, pinned
+}
+
+func LoadOverrides(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "reading overrides file failed")
+	}
+	saved := Overrides{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return errors.Wrap(err, "decoding overrides file failed")
+	}
+	overrideMux.Lock()
+	defer overrideMux.Unlock()
+	overrides = saved
+	return nil
+}
+
+func SaveOverrides(filename string) error {
+	data, err := json.Marshal(GetOverrides())
+	if err != nil {
+		return errors.Wrap(err, "encoding overrides failed")
+	}
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "writing overrides file failed")
+	}
+	return errors.Wrap(os.Rename(tmp, filename), "replacing overrides file failed")
+}
@@ -0,0 +1,65 @@
+package check
+
+import (
+	"testing"
+	"vc/sub"
+	"vc/vc"
+)
+
+func TestBalanceOverrides(t *testing.T) {
+	saved, tag := GetOverrides(), fallbackTag
+	t.Cleanup(func() {
+		overrides, fallbackTag = saved, tag
+	})
+	fallbackTag = "direct"
+	a, err := sub.FromShareUrl("vless://id@a.example.com:443#a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sub.FromShareUrl("vless://id@b.example.com:443#b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := func(outbounds ...*vc.Outbound) *vc.Config {
+		return &vc.Config{
+			Outbounds: append([]*vc.Outbound{{Tag: "a"}, {Tag: "b"}}, outbounds...),
+			Routing:   &vc.Routing{Balancers: []*vc.Balancer{{Tag: "main", Selector: []string{"a", "b"}}}},
+		}
+	}
+	tests := []struct {
+		name     string
+		pinned   []string
+		excluded []string
+		cfg      *vc.Config
+		want     []string
+	}{
+		{name: "pinned", pinned: []string{"b"}, cfg: config(), want: []string{"b"}},
+		{name: "excluded", excluded: []string{"a"}, cfg: config(), want: []string{"b"}},
+		{name: "pinned and excluded", pinned: []string{"a"}, excluded: []string{"a"}, cfg: config(), want: []string{"b"}},
+		{
+			name:     "all excluded",
+			excluded: []string{"a", "b"},
+			cfg:      config(&vc.Outbound{Tag: "direct", Protocol: "freedom"}),
+			want:     []string{"direct"},
+		},
+		{name: "all excluded without fallback", excluded: []string{"a", "b"}, cfg: config(), want: []string{blockTag}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overrides = Overrides{Pinned: tt.pinned, Excluded: tt.excluded}
+			cfg, err := Balance(tt.cfg, []sub.Endpoint{a, b})
+			if err != nil {
+				t.Fatal(err)
+			}
+			selector := cfg.Routing.Balancers[0].Selector
+			if len(selector) != len(tt.want) {
+				t.Fatalf("main balancer selects %v, want %v", selector, tt.want)
+			}
+			for i := range selector {
+				if selector[i] != tt.want[i] {
+					t.Errorf("main balancer selects %v, want %v", selector, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package check
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"vc/sub"
+)
+
+// Probe verifies an endpoint through its check port.
+type Probe interface {
+	Name() string
+	Probe(ctx context.Context, ep sub.Endpoint) error
+}
+
+var (
+	probeNames  = "http"
+	testUrl     = "https://httpbin.org/get"
+	httpMethod  = http.MethodGet
+	httpStatus  = "200"
+	httpBody    = ""
+	tcpTarget   = "1.1.1.1:443"
+	tlsTarget   = "www.cloudflare.com:443"
+	dnsServer   = "1.1.1.1:53"
+	dnsName     = "www.google.com"
+	probes      []ProbeGroup
+	maxBodySize = int64(1 << 20)
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_CHECK_URL"); ok {
+		for _, u := range splitList(s) {
+			if _, err := url.Parse(u); err != nil {
+				slog.Info(fmt.Sprintf("Invalid check url: %q", u))
+			}
+		}
+		testUrl = s
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_PROBES"); ok && s != "" {
+		probeNames = s
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_HTTP_METHOD"); ok && s != "" {
+		httpMethod = strings.ToUpper(s)
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_HTTP_STATUS"); ok && s != "" {
+		httpStatus = s
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_HTTP_BODY"); ok {
+		httpBody = s
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_TCP_TARGET"); ok && s != "" {
+		tcpTarget = s
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_TLS_TARGET"); ok && s != "" {
+		tlsTarget = s
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_DNS_SERVER"); ok && s != "" {
+		dnsServer = s
+	}
+	if s, ok := os.LookupEnv("VC_CHECK_DNS_NAME"); ok && s != "" {
+		dnsName = s
+	}
+	var err error
+	probes, err = ParseProbes(probeNames)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Invalid check probes: %q, use http probe only", probeNames), slog.ErrorKey, err)
+		group := ProbeGroup{Kind: "http"}
+		for _, u := range splitList(testUrl) {
+			group.Probes = append(group.Probes, &HttpProbe{Method: http.MethodGet, Url: u, MinStatus: 200, MaxStatus: 200})
+		}
+		probes = []ProbeGroup{group}
+	}
+}
+
+// ProbeGroup holds the probes of one kind, one for each of its targets.
+type ProbeGroup struct {
+	Kind   string
+	Probes []Probe
+}
+
+// ParseProbes builds probes from a comma separated list of probe names,
+// e.g. "http,tcp,tls,dns". A probe is built for each configured target of
+// its kind, grouped by kind, and the quorum decides how many probes of each
+// group must pass.
+func ParseProbes(names string) ([]ProbeGroup, error) {
+	var groups []ProbeGroup
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		var ps []Probe
+		switch name {
+		case "":
+			continue
+		case "http":
+			minStatus, maxStatus, err := parseStatusRange(httpStatus)
+			if err != nil {
+				return nil, err
+			}
+			for _, u := range splitList(testUrl) {
+				ps = append(ps, &HttpProbe{
+					Method:       httpMethod,
+					Url:          u,
+					MinStatus:    minStatus,
+					MaxStatus:    maxStatus,
+					BodyContains: httpBody,
+				})
+			}
+		case "tcp":
+			for _, target := range splitList(tcpTarget) {
+				ps = append(ps, &TcpProbe{Target: target})
+			}
+		case "tls":
+			for _, target := range splitList(tlsTarget) {
+				ps = append(ps, &TlsProbe{Target: target})
+			}
+		case "dns":
+			for _, server := range splitList(dnsServer) {
+				ps = append(ps, &DnsProbe{Server: server, Domain: dnsName})
+			}
+		default:
+			return nil, errors.Errorf("unknown probe: %q", name)
+		}
+		if len(ps) == 0 {
+			return nil, errors.Errorf("no target configured for probe %q", name)
+		}
+		groups = append(groups, ProbeGroup{Kind: name, Probes: ps})
+	}
+	if len(groups) == 0 {
+		return nil, errors.Errorf("no probe configured")
+	}
+	return groups, nil
+}
+
+func parseStatusRange(s string) (int, int, error) {
+	lo, hi := divideStr(s, "-")
+	minStatus, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid status range %q", s)
+	}
+	if hi == "" {
+		return minStatus, minStatus, nil
+	}
+	maxStatus, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil || maxStatus < minStatus {
+		return 0, 0, errors.Errorf("invalid status range %q", s)
+	}
+	return minStatus, maxStatus, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func divideStr(s string, sep string) (string, string) {
+	parts := strings.SplitN(s, sep, 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return s, ""
+}
+
+type HttpProbe struct {
+	Method       string
+	Url          string
+	MinStatus    int
+	MaxStatus    int
+	BodyContains string
+}
+
+func (p *HttpProbe) Name() string {
+	return fmt.Sprintf("http %s %s", p.Method, p.Url)
+}
+
+func (p *HttpProbe) Probe(ctx context.Context, ep sub.Endpoint) error {
+	tr := &http.Transport{
+		Proxy: func(_ *http.Request) (*url.URL, error) {
+			return url.Parse(fmt.Sprintf("socks5://127.0.0.1:%d", ep.CheckPort()))
+		},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	req, err := http.NewRequestWithContext(ctx, p.Method, p.Url, nil)
+	if err != nil {
+		return errors.Wrap(err, "building request failed")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < p.MinStatus || resp.StatusCode > p.MaxStatus {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	if p.BodyContains == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return errors.Wrap(err, "reading response body failed")
+	}
+	if !bytes.Contains(body, []byte(p.BodyContains)) {
+		return errors.Errorf("response body does not contain %q", p.BodyContains)
+	}
+	return nil
+}
+
+type TcpProbe struct {
+	Target string
+}
+
+func (p *TcpProbe) Name() string {
+	return "tcp " + p.Target
+}
+
+func (p *TcpProbe) Probe(ctx context.Context, ep sub.Endpoint) error {
+	conn, err := dialSocks(ctx, ep.CheckPort(), p.Target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type TlsProbe struct {
+	Target     string
+	ServerName string
+}
+
+func (p *TlsProbe) Name() string {
+	return "tls " + p.Target
+}
+
+func (p *TlsProbe) Probe(ctx context.Context, ep sub.Endpoint) error {
+	conn, err := dialSocks(ctx, ep.CheckPort(), p.Target)
+	if err != nil {
+		return err
+	}
+	serverName := p.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(p.Target)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+	defer func() {
+		_ = tlsConn.Close()
+	}()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return errors.Wrap(err, "tls handshake failed")
+	}
+	return nil
+}
+
+type DnsProbe struct {
+	Server string
+	Domain string
+}
+
+func (p *DnsProbe) Name() string {
+	return fmt.Sprintf("dns %s@%s", p.Domain, p.Server)
+}
+
+func (p *DnsProbe) Probe(ctx context.Context, ep sub.Endpoint) error {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			// a stream conn makes the resolver use dns over tcp
+			return dialSocks(ctx, ep.CheckPort(), p.Server)
+		},
+	}
+	addrs, err := resolver.LookupHost(ctx, p.Domain)
+	if err != nil {
+		return errors.Wrap(err, "resolving failed")
+	}
+	if len(addrs) == 0 {
+		return errors.Errorf("no address resolved for %s", p.Domain)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package check
+
+import (
+	"fmt"
+	"golang.org/x/exp/slog"
+	"os"
+	"sort"
+	"strconv"
+	"vc/sub"
+)
+
+const (
+	RankNone       = ""
+	RankThroughput = "throughput"
+	RankUptime     = "uptime"
+	RankLatency    = "latency"
+)
+
+var (
+	rankBy  = RankNone
+	rankTop = 0
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_BALANCE_RANK"); ok {
+		switch s {
+		case RankNone, RankThroughput, RankUptime, RankLatency:
+			rankBy = s
+		default:
+			slog.Info(fmt.Sprintf("Invalid balance rank: %q, ranking disabled", s))
+		}
+	}
+	if s, ok := os.LookupEnv("VC_BALANCE_TOP"); ok {
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || i < 0 {
+			slog.Info(fmt.Sprintf("Invalid balance top: %q, use default value: %d", s, rankTop))
+		} else {
+			rankTop = int(i)
+		}
+	}
+}
+
+func RankBy() string {
+	return rankBy
+}
+
+// rank orders endpoints by the configured criterion, best first, and keeps the
+// top VC_BALANCE_TOP of them. Endpoints without a measurement go last.
+func rank(eps []sub.Endpoint) []sub.Endpoint {
+	if rankBy == RankNone {
+		return eps
+	}
+	scores := make(map[string]float64, len(eps))
+	for _, ep := range eps {
+		if score, found := rankScore(ep); found {
+			scores[ep.Share()] = score
+		}
+	}
+	ranked := make([]sub.Endpoint, len(eps))
+	copy(ranked, eps)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		si, iFound := scores[ranked[i].Share()]
+		sj, jFound := scores[ranked[j].Share()]
+		if iFound != jFound {
+			return iFound
+		}
+		return si > sj
+	})
+	if rankTop > 0 && len(ranked) > rankTop {
+		ranked = ranked[:rankTop]
+	}
+	return ranked
+}
+
+// rankScore scores an endpoint by the ranking criterion, higher is better.
+func rankScore(ep sub.Endpoint) (float64, bool) {
+	switch rankBy {
+	case RankThroughput:
+		healthMux.Lock()
+		defer healthMux.Unlock()
+		if h, found := healths[ep.Share()]; found && !h.throughputAt.IsZero() {
+			return h.throughput, true
+		}
+	case RankUptime:
+		if s, found := historyStat(ep); found {
+			return s.Uptime, true
+		}
+	case RankLatency:
+		if s, found := historyStat(ep); found && s.MeanLatencyMs > 0 {
+			return -float64(s.MeanLatencyMs), true
+		}
+	}
+	return 0, false
+}
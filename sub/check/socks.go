@@ -0,0 +1,112 @@
+package check
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// dialSocks opens a tcp connection to target through the socks5 inbound
+// listening on the given local port.
+func dialSocks(ctx context.Context, port int, target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid target %q", target)
+	}
+	dstPort, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid target port %q", portStr)
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting socks inbound failed")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := socksHandshake(conn, host, uint16(dstPort)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// ProbeInbound makes sure a core proxies through the socks5 inbound on the
+// given local port, by connecting to the first tcp probe target through it.
+func ProbeInbound(ctx context.Context, port int) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(timeoutSec))
+	defer cancel()
+	targets := splitList(tcpTarget)
+	if len(targets) == 0 {
+		return errors.Errorf("no tcp probe target")
+	}
+	conn, err := dialSocks(ctx, port, targets[0])
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func socksHandshake(conn net.Conn, host string, port uint16) error {
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return errors.Wrap(err, "writing socks greeting failed")
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.Wrap(err, "reading socks greeting failed")
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return errors.Errorf("socks auth method rejected: %v", reply)
+	}
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.Errorf("host name too long: %s", host)
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return errors.Wrap(err, "writing socks connect request failed")
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return errors.Wrap(err, "reading socks connect reply failed")
+	}
+	if head[1] != 0 {
+		return errors.Errorf("socks connect to %s failed with code %d", net.JoinHostPort(host, strconv.Itoa(int(port))), head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return errors.Wrap(err, "reading socks bound address failed")
+		}
+		skip = int(l[0])
+	default:
+		return errors.Errorf("unknown socks address type %d", head[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return errors.Wrap(err, "reading socks bound address failed")
+	}
+	return nil
+}
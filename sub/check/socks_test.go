@@ -0,0 +1,208 @@
+package check
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// serveSocks runs a minimal socks5 server relaying connect requests, and
+// returns its port.
+func serveSocks(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go relaySocks(conn)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func relaySocks(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte{5, 0})
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	var host string
+	switch head[3] {
+	case 1:
+		ip := make([]byte, net.IPv4len)
+		_, _ = io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		l := make([]byte, 1)
+		_, _ = io.ReadFull(conn, l)
+		name := make([]byte, l[0])
+		_, _ = io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() {
+		_ = upstream.Close()
+	}()
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+	}()
+	_, _ = io.Copy(conn, upstream)
+}
+
+func TestSocksHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		port    uint16
+		reply   []byte
+		request []byte
+		wantErr bool
+	}{
+		{
+			name:    "domain",
+			host:    "example.com",
+			port:    443,
+			reply:   []byte{5, 0, 5, 0, 0, 1, 1, 2, 3, 4, 0, 80},
+			request: append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 1, 187),
+		},
+		{
+			name:    "ipv4",
+			host:    "1.2.3.4",
+			port:    80,
+			reply:   []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+			request: []byte{5, 1, 0, 1, 1, 2, 3, 4, 0, 80},
+		},
+		{
+			name:    "ipv6 with domain bound address",
+			host:    "::1",
+			port:    53,
+			reply:   []byte{5, 0, 5, 0, 0, 3, 1, 'a', 0, 0},
+			request: append(append([]byte{5, 1, 0, 4}, net.IPv6loopback...), 0, 53),
+		},
+		{
+			name:    "auth rejected",
+			host:    "1.2.3.4",
+			port:    80,
+			reply:   []byte{5, 0xff},
+			wantErr: true,
+		},
+		{
+			name:    "connect refused",
+			host:    "1.2.3.4",
+			port:    80,
+			reply:   []byte{5, 0, 5, 5, 0, 1, 0, 0, 0, 0, 0, 0},
+			request: []byte{5, 1, 0, 1, 1, 2, 3, 4, 0, 80},
+			wantErr: true,
+		},
+		{
+			name:    "unknown address type",
+			host:    "1.2.3.4",
+			port:    80,
+			reply:   []byte{5, 0, 5, 0, 0, 9},
+			request: []byte{5, 1, 0, 1, 1, 2, 3, 4, 0, 80},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer func() {
+				_ = client.Close()
+			}()
+			received := make(chan []byte, 1)
+			go func() {
+				defer func() {
+					_ = server.Close()
+				}()
+				greeting := make([]byte, 3)
+				_, _ = io.ReadFull(server, greeting)
+				_, _ = server.Write(tt.reply[:2])
+				if len(tt.reply) == 2 {
+					received <- nil
+					return
+				}
+				request := make([]byte, len(tt.request))
+				_, _ = io.ReadFull(server, request)
+				received <- request
+				_, _ = server.Write(tt.reply[2:])
+			}()
+			err := socksHandshake(client, tt.host, tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("socksHandshake() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if request := <-received; !bytes.Equal(request, tt.request) && tt.request != nil {
+				t.Errorf("request = %v, want %v", request, tt.request)
+			}
+		})
+	}
+}
+
+func TestDialSocks(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.Close()
+	}()
+	conn, err := dialSocks(testContext(t), serveSocks(t), target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	if _, err := dialSocks(testContext(t), serveSocks(t), "no-port"); err == nil {
+		t.Errorf("dialSocks() with invalid target succeeded")
+	}
+}
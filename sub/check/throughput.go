@@ -0,0 +1,112 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+	"vc/sub"
+)
+
+var (
+	throughputUrl        = "https://speed.cloudflare.com/__down?bytes=10000000"
+	throughputBytes      = int64(10_000_000)
+	throughputTimeoutSec = 15
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_THROUGHPUT_URL"); ok && s != "" {
+		if _, err := url.Parse(s); err != nil {
+			slog.Info(fmt.Sprintf("Invalid throughput url: %q, use default value: %q", s, throughputUrl))
+		} else {
+			throughputUrl = s
+		}
+	}
+	if s, ok := os.LookupEnv("VC_THROUGHPUT_BYTES"); ok {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || i <= 0 {
+			slog.Info(fmt.Sprintf("Invalid throughput bytes: %q, use default value: %d", s, throughputBytes))
+		} else {
+			throughputBytes = i
+		}
+	}
+	if s, ok := os.LookupEnv("VC_THROUGHPUT_TIMEOUT"); ok {
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || i <= 0 {
+			slog.Info(fmt.Sprintf("Invalid throughput timeout: %q, use default value: %d", s, throughputTimeoutSec))
+		} else {
+			throughputTimeoutSec = int(i)
+		}
+	}
+}
+
+// Throughput downloads the throughput test resource via the endpoint's check
+// port, bounded by VC_THROUGHPUT_BYTES and VC_THROUGHPUT_TIMEOUT, and returns
+// the measured rate in Mbps.
+func Throughput(ctx context.Context, ep sub.Endpoint) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(throughputTimeoutSec))
+	defer cancel()
+	tr := &http.Transport{
+		Proxy: func(_ *http.Request) (*url.URL, error) {
+			return url.Parse(fmt.Sprintf("socks5://127.0.0.1:%d", ep.CheckPort()))
+		},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, throughputUrl, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "building request failed")
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, throughputBytes))
+	elapsed := time.Since(start)
+	if n == 0 {
+		if err == nil {
+			err = errors.Errorf("empty response")
+		}
+		return 0, err
+	}
+	// running out of time still gives a usable sample
+	if err != nil && ctx.Err() == nil {
+		return 0, err
+	}
+	return float64(n) * 8 / elapsed.Seconds() / 1e6, nil
+}
+
+// MeasureThroughput tests endpoints one by one, so that they do not compete
+// for bandwidth, and records the results for reporting and ranking.
+func MeasureThroughput(ctx context.Context, eps []sub.Endpoint) {
+	for _, ep := range eps {
+		mbps, err := Throughput(ctx, ep)
+		if err != nil {
+			slog.Info(fmt.Sprintf("throughput test via ep %s failed: %+v", ep.Tag(), err))
+		} else {
+			slog.Info(fmt.Sprintf("throughput via ep %s: %.2f Mbps", ep.Tag(), mbps))
+		}
+		healthMux.Lock()
+		h, found := healths[ep.Share()]
+		if !found {
+			h = &health{tag: ep.Tag(), healthy: true}
+			healths[ep.Share()] = h
+		}
+		h.throughput = mbps
+		h.throughputAt = time.Now()
+		healthMux.Unlock()
+	}
+}
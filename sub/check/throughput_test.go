@@ -0,0 +1,103 @@
+package check
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"vc/sub"
+)
+
+func testEndpoint(t *testing.T, tag string, checkPort int) sub.Endpoint {
+	t.Helper()
+	ep, err := sub.FromShareUrl("vless://id@example.com:443#" + tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep.SetCheckPort(checkPort)
+	return ep
+}
+
+// closedPort returns a local port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	return port
+}
+
+func serveDownload(t *testing.T, size int) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		_, _ = w.Write(make([]byte, size))
+	}))
+	t.Cleanup(srv.Close)
+	url, bytes := throughputUrl, throughputBytes
+	throughputUrl, throughputBytes = srv.URL, int64(size)
+	t.Cleanup(func() {
+		throughputUrl, throughputBytes = url, bytes
+	})
+}
+
+func TestThroughput(t *testing.T) {
+	serveDownload(t, 1<<20)
+	mbps, err := Throughput(testContext(t), testEndpoint(t, "up", serveSocks(t)))
+	if err != nil || mbps <= 0 {
+		t.Errorf("Throughput() = %v, %v, want a positive rate", mbps, err)
+	}
+	if _, err := Throughput(testContext(t), testEndpoint(t, "down", closedPort(t))); err == nil {
+		t.Errorf("Throughput() through a closed port succeeded")
+	}
+}
+
+func TestRankByThroughput(t *testing.T) {
+	serveDownload(t, 1<<20)
+	by, top := rankBy, rankTop
+	t.Cleanup(func() {
+		rankBy, rankTop = by, top
+		healthMux.Lock()
+		healths = map[string]*health{}
+		healthMux.Unlock()
+	})
+	down := testEndpoint(t, "down", closedPort(t))
+	up := testEndpoint(t, "up", serveSocks(t))
+	unmeasured, err := sub.FromShareUrl("vless://id@example.org:443#unmeasured")
+	if err != nil {
+		t.Fatal(err)
+	}
+	MeasureThroughput(testContext(t), []sub.Endpoint{down, up})
+	tests := []struct {
+		name string
+		by   string
+		top  int
+		want []string
+	}{
+		{name: "disabled", by: RankNone, want: []string{"unmeasured", "down", "up"}},
+		{name: "throughput", by: RankThroughput, want: []string{"up", "down", "unmeasured"}},
+		{name: "top", by: RankThroughput, top: 1, want: []string{"up"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rankBy, rankTop = tt.by, tt.top
+			ranked := rank([]sub.Endpoint{unmeasured, down, up})
+			var got []string
+			for _, ep := range ranked {
+				got = append(got, ep.Tag())
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("rank() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("rank() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
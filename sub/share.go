@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"net/url"
 	"strconv"
 	"strings"
 	"vc/vc"
@@ -12,6 +13,7 @@ import (
 
 type Endpoint interface {
 	Tag() string
+	SetTag(tag string)
 	Share() string
 	CheckPort() int
 	SetCheckPort(p int)
@@ -32,6 +34,10 @@ func (e *SsEndpoint) Tag() string {
 	return e.tag
 }
 
+func (e *SsEndpoint) SetTag(tag string) {
+	e.tag = tag
+}
+
 func (e *SsEndpoint) Share() string {
 	return e.share
 }
@@ -85,6 +91,10 @@ func (e *VMessEndpoint) Tag() string {
 	return e.tag
 }
 
+func (e *VMessEndpoint) SetTag(tag string) {
+	e.tag = tag
+}
+
 func (e *VMessEndpoint) Share() string {
 	return e.share
 }
@@ -227,6 +237,141 @@ func (e *VMessEndpoint) Outbound() *vc.Outbound {
 	}
 }
 
+type VLessEndpoint struct {
+	tag         string
+	share       string
+	checkPort   int
+	address     string
+	port        json.Number
+	id          string
+	encryption  string
+	flow        string
+	net         string
+	headerType  string
+	host        string
+	path        string
+	serviceName string
+	security    string
+	sni         string
+	alpn        string
+	fingerprint string
+	publicKey   string
+	shortId     string
+	spiderX     string
+}
+
+func (e *VLessEndpoint) Tag() string {
+	return e.tag
+}
+
+func (e *VLessEndpoint) SetTag(tag string) {
+	e.tag = tag
+}
+
+func (e *VLessEndpoint) Share() string {
+	return e.share
+}
+
+func (e *VLessEndpoint) CheckPort() int {
+	return e.checkPort
+}
+
+func (e *VLessEndpoint) SetCheckPort(p int) {
+	e.checkPort = p
+}
+
+func (e *VLessEndpoint) Outbound() *vc.Outbound {
+	encryption := e.encryption
+	if encryption == "" {
+		encryption = "none"
+	}
+	ss := &vc.StreamSettings{
+		Network:  e.net,
+		Security: "none",
+	}
+	switch e.net {
+	case "", "tcp":
+		ss.Network = "tcp"
+		if e.headerType == "http" {
+			ss.TcpSettings = &vc.TcpSettings{
+				Header: &vc.Headers{Type: "http"},
+			}
+			if e.host != "" {
+				ss.TcpSettings.Header.Request = &vc.Request{
+					Headers: map[string]any{
+						"Host": strings.Split(e.host, ","),
+					},
+				}
+			}
+		}
+	case "ws":
+		ss.WsSettings = &vc.WsSettings{
+			Path:    e.path,
+			Headers: map[string]any{},
+		}
+		if e.host != "" {
+			ss.WsSettings.Headers["Host"] = e.host
+		}
+	case "http", "h2":
+		ss.Network = "http"
+		ss.HttpSettings = &vc.HttpSettings{Path: e.path}
+		if e.host != "" {
+			ss.HttpSettings.Host = strings.Split(e.host, ",")
+		}
+	case "grpc":
+		ss.GrpcSettings = &vc.GrpcSettings{
+			ServiceName: e.serviceName,
+			MultiMode:   e.headerType == "multi",
+		}
+	}
+	sni := e.sni
+	if sni == "" {
+		sni = e.host
+	}
+	switch e.security {
+	case "tls":
+		ss.Security = "tls"
+		ss.TlsSettings = &vc.TlsSettings{
+			ServerName:  sni,
+			Fingerprint: e.fingerprint,
+		}
+		if e.alpn != "" {
+			ss.TlsSettings.Alpn = strings.Split(e.alpn, ",")
+		}
+	case "reality":
+		ss.Security = "reality"
+		ss.RealitySettings = &vc.RealitySettings{
+			ServerName:  sni,
+			Fingerprint: e.fingerprint,
+			PublicKey:   e.publicKey,
+			ShortId:     e.shortId,
+			SpiderX:     e.spiderX,
+		}
+	}
+	return &vc.Outbound{
+		SendThrough: "0.0.0.0",
+		Protocol:    "vless",
+		Settings: &vc.OutboundCommonSettings{
+			VNext: []*vc.VNext{
+				{
+					Address: e.address,
+					Port:    e.port,
+					Users: []*vc.User{
+						{
+							Id:         e.id,
+							Encryption: encryption,
+							Flow:       e.flow,
+						},
+					},
+				},
+			},
+		},
+		Tag:            e.tag,
+		StreamSettings: ss,
+		Mux:            &vc.Mux{},
+	}
+}
+
 func FromSsShareUrl(shareUrl string) (Endpoint, error) {
 	encStr, tag := divideStr(shareUrl[5:], "#")
 	decData, err := base64.RawURLEncoding.DecodeString(encStr)
@@ -278,7 +423,7 @@ func FromVMessShareUrl(shareUrl string) (Endpoint, error) {
 	}
 	tag := share.Ps
 	if tag == "" {
-		tag = fmt.Sprintf("%s-%d", share.Address, share.Port)
+		tag = fmt.Sprintf("%s-%s", share.Address, share.Port)
 	}
 	return &VMessEndpoint{
 		tag:      tag,
@@ -297,6 +442,42 @@ func FromVMessShareUrl(shareUrl string) (Endpoint, error) {
 	}, nil
 }
 
+func FromVLessShareUrl(shareUrl string) (Endpoint, error) {
+	u, err := url.Parse(shareUrl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing vless share url failed")
+	}
+	if u.User == nil || u.User.Username() == "" || u.Hostname() == "" || u.Port() == "" {
+		return nil, errors.Errorf("invalid vless share url: %s", shareUrl)
+	}
+	q := u.Query()
+	tag := u.Fragment
+	if tag == "" {
+		tag = fmt.Sprintf("%s-%s", u.Hostname(), u.Port())
+	}
+	return &VLessEndpoint{
+		tag:         tag,
+		share:       shareUrl,
+		address:     u.Hostname(),
+		port:        json.Number(u.Port()),
+		id:          u.User.Username(),
+		encryption:  q.Get("encryption"),
+		flow:        q.Get("flow"),
+		net:         q.Get("type"),
+		headerType:  q.Get("headerType"),
+		host:        q.Get("host"),
+		path:        q.Get("path"),
+		serviceName: q.Get("serviceName"),
+		security:    q.Get("security"),
+		sni:         q.Get("sni"),
+		alpn:        q.Get("alpn"),
+		fingerprint: q.Get("fp"),
+		publicKey:   q.Get("pbk"),
+		shortId:     q.Get("sid"),
+		spiderX:     q.Get("spx"),
+	}, nil
+}
+
 func FromShareUrl(shareUrl string) (Endpoint, error) {
 	parts := strings.Split(shareUrl, "://")
 	switch parts[0] {
@@ -304,6 +485,8 @@ func FromShareUrl(shareUrl string) (Endpoint, error) {
 		return FromSsShareUrl(shareUrl)
 	case "vmess":
 		return FromVMessShareUrl(shareUrl)
+	case "vless":
+		return FromVLessShareUrl(shareUrl)
 	default:
 		return nil, errors.Errorf("unsupported share url: %s", shareUrl)
 	}
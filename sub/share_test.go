@@ -0,0 +1,90 @@
+package sub
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFromVLessShareUrl(t *testing.T) {
+	tests := []struct {
+		name    string
+		share   string
+		wantErr bool
+		// want is the expected outbound, compared as json
+		want string
+	}{
+		{
+			name:  "tcp without tag",
+			share: "vless://uuid@example.com:443",
+			want: `{"sendThrough":"0.0.0.0","protocol":"vless","settings":{"vnext":[{"address":"example.com","port":443,` +
+				`"users":[{"id":"uuid","alterId":0,"encryption":"none","level":0}]}]},"streamSettings":{"network":"tcp","security":"none"},` +
+				`"tag":"example.com-443","mux":{"enabled":false}}`,
+		},
+		{
+			name:  "ws tls",
+			share: "vless://uuid@1.2.3.4:8443?type=ws&security=tls&host=cdn.example.com&path=%2Fws&alpn=h2,http/1.1&fp=chrome#ws%20node",
+			want: `{"sendThrough":"0.0.0.0","protocol":"vless","settings":{"vnext":[{"address":"1.2.3.4","port":8443,` +
+				`"users":[{"id":"uuid","alterId":0,"encryption":"none","level":0}]}]},"streamSettings":{"network":"ws","security":"tls",` +
+				`"tlsSettings":{"allowInsecure":false,"serverName":"cdn.example.com","alpn":["h2","http/1.1"],"fingerprint":"chrome"},` +
+				`"wsSettings":{"path":"/ws","headers":{"Host":"cdn.example.com"}}},"tag":"ws node","mux":{"enabled":false}}`,
+		},
+		{
+			name:  "reality vision",
+			share: "vless://uuid@example.com:443?security=reality&sni=www.example.org&pbk=key&sid=ab&fp=chrome&flow=xtls-rprx-vision&type=tcp#r",
+			want: `{"sendThrough":"0.0.0.0","protocol":"vless","settings":{"vnext":[{"address":"example.com","port":443,` +
+				`"users":[{"id":"uuid","alterId":0,"encryption":"none","flow":"xtls-rprx-vision","level":0}]}]},"streamSettings":{"network":"tcp",` +
+				`"security":"reality","realitySettings":{"serverName":"www.example.org","fingerprint":"chrome",` +
+				`"publicKey":"key","shortId":"ab"}},"tag":"r","mux":{"enabled":false}}`,
+		},
+		{
+			name:  "grpc multi",
+			share: "vless://uuid@example.com:443?type=grpc&serviceName=svc&headerType=multi&security=tls#g",
+			want: `{"sendThrough":"0.0.0.0","protocol":"vless","settings":{"vnext":[{"address":"example.com","port":443,` +
+				`"users":[{"id":"uuid","alterId":0,"encryption":"none","level":0}]}]},"streamSettings":{"network":"grpc","security":"tls",` +
+				`"tlsSettings":{"allowInsecure":false},"grpcSettings":{"serviceName":"svc","multiMode":true}},"tag":"g","mux":{"enabled":false}}`,
+		},
+		{
+			name:    "no user",
+			share:   "vless://example.com:443",
+			wantErr: true,
+		},
+		{
+			name:    "no port",
+			share:   "vless://uuid@example.com",
+			wantErr: true,
+		},
+		{
+			name:    "invalid url",
+			share:   "vless://uuid@exa mple.com:%zz",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, err := FromShareUrl(tt.share)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromShareUrl() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ep.Share() != tt.share {
+				t.Errorf("Share() = %q, want %q", ep.Share(), tt.share)
+			}
+			data, err := json.Marshal(ep.Outbound())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want any
+			_ = json.Unmarshal(data, &got)
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			gotData, _ := json.Marshal(got)
+			wantData, _ := json.Marshal(want)
+			if string(gotData) != string(wantData) {
+				t.Errorf("Outbound() =\n%s\nwant\n%s", gotData, wantData)
+			}
+		})
+	}
+}
@@ -28,8 +28,11 @@ func fetchHttp(address string) ([]byte, error) {
 	return data, nil
 }
 
-func decodeEndpoints(data []byte) []Endpoint {
-	var eps []Endpoint
+func decodeEndpoints(data []byte) ([]Endpoint, int) {
+	var (
+		eps      []Endpoint
+		rejected int
+	)
 	scanner := bufio.NewScanner(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data)))
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -39,25 +42,55 @@ func decodeEndpoints(data []byte) []Endpoint {
 		ep, err := FromShareUrl(line)
 		if err != nil {
 			slog.Warn(fmt.Sprintf("parsing share url failed: %+v", err))
+			rejected++
+			continue
 		}
 		eps = append(eps, ep)
 	}
 	if err := scanner.Err(); err != nil {
 		slog.Warn(fmt.Sprintf("decoding && reading base64 data failed: %+v", err))
 	}
-	return eps
+	return UniqueTags(eps), rejected
+}
+
+// UniqueTags drops the endpoints of repeated share urls, and suffixes repeated
+// tags with a sequence number, so that the tag identifies an endpoint.
+func UniqueTags(eps []Endpoint) []Endpoint {
+	shares := make(map[string]bool, len(eps))
+	tags := make(map[string]bool, len(eps))
+	unique := make([]Endpoint, 0, len(eps))
+	for _, ep := range eps {
+		if shares[ep.Share()] {
+			slog.Warn(fmt.Sprintf("endpoint %s is repeated, ignored", ep.Tag()))
+			continue
+		}
+		shares[ep.Share()] = true
+		tag := ep.Tag()
+		for i := 2; tags[tag]; i++ {
+			tag = fmt.Sprintf("%s-%d", ep.Tag(), i)
+		}
+		if tag != ep.Tag() {
+			slog.Info(fmt.Sprintf("endpoint tag %s is repeated, renamed to %s", ep.Tag(), tag))
+			ep.SetTag(tag)
+		}
+		tags[tag] = true
+		unique = append(unique, ep)
+	}
+	return unique
 }
 
-func FetchEndpoints(address string) ([]Endpoint, error) {
+// FetchEndpoints fetches and parses the subscription, and returns the
+// endpoints with the number of share urls failed to parse.
+func FetchEndpoints(address string) ([]Endpoint, int, error) {
 	encData, err := fetchHttp(address)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	eps := decodeEndpoints(encData)
+	eps, rejected := decodeEndpoints(encData)
 	if len(eps) == 0 {
-		return nil, errors.Errorf("got none endpoint")
+		return nil, rejected, errors.Errorf("got none endpoint")
 	}
-	return eps, nil
+	return eps, rejected, nil
 }
 
 func Override(base *vc.Config, eps []Endpoint) (*vc.Config, error) {
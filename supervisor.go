@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"vc/vc"
+)
+
+const (
+	CoreStarting  = "starting"
+	CoreRunning   = "running"
+	CoreBackoff   = "backoff"
+	CoreCrashLoop = "crash-loop"
+	CoreFailed    = "failed"
+	CoreStopped   = "stopped"
+)
+
+var (
+	coreBackoffMin  = time.Second
+	coreBackoffMax  = time.Minute
+	coreStableAfter = time.Second * 30
+	coreCrashLoop   = 3
+	coreMaxRestarts = 0
+	coreStopTimeout = time.Second * 10
+	coreReady       = time.Second * 30
+	readyInterval   = time.Millisecond * 200
+)
+
+func init() {
+	seconds := func(name string, d *time.Duration) {
+		if s := os.Getenv(name); s != "" {
+			if sec, err := strconv.ParseInt(s, 10, 64); err != nil || sec <= 0 {
+				slog.Warn(fmt.Sprintf("invalid environment value: %s=%s", name, s))
+			} else {
+				*d = time.Second * time.Duration(sec)
+			}
+		}
+	}
+	seconds("VC_CORE_BACKOFF_MIN", &coreBackoffMin)
+	seconds("VC_CORE_BACKOFF_MAX", &coreBackoffMax)
+	seconds("VC_CORE_STABLE_AFTER", &coreStableAfter)
+	seconds("VC_CORE_STOP_TIMEOUT", &coreStopTimeout)
+	seconds("VC_CORE_READY_TIMEOUT", &coreReady)
+	if s := os.Getenv("VC_CORE_CRASH_LOOP"); s != "" {
+		if i, err := strconv.Atoi(s); err != nil || i < 1 {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_CORE_CRASH_LOOP=%s", s))
+		} else {
+			coreCrashLoop = i
+		}
+	}
+	if s := os.Getenv("VC_CORE_MAX_RESTARTS"); s != "" {
+		if i, err := strconv.Atoi(s); err != nil || i < 0 {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_CORE_MAX_RESTARTS=%s", s))
+		} else {
+			coreMaxRestarts = i
+		}
+	}
+}
+
+// instance is a running core process, serving on its configured ports plus
+// offset.
+type instance struct {
+	cmd       *exec.Cmd
+	log       *coreLog
+	offset    int
+	startedAt time.Time
+	exited    chan struct{}
+	err       error
+}
+
+func launch(filename string, offset int) (*instance, error) {
+	coreFile, err := renderCoreConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	log := &coreLog{}
+	i := &instance{
+		cmd:    coreCmd(coreFile, log),
+		log:    log,
+		offset: offset,
+		exited: make(chan struct{}),
+	}
+	if err := i.cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "starting core failed")
+	}
+	i.startedAt = time.Now()
+	log.started(i.cmd.Process.Pid)
+	go func() {
+		i.err = i.cmd.Wait()
+		if i.err != nil {
+			slog.Error(fmt.Sprintf("core %d exited", i.cmd.Process.Pid), i.err)
+		} else {
+			slog.Info(fmt.Sprintf("core %d stopped.", i.cmd.Process.Pid))
+		}
+		close(i.exited)
+	}()
+	return i, nil
+}
+
+// exitErr returns why the core exited, with the fatal error it reported.
+func (i *instance) exitErr() error {
+	if fatal := i.log.Fatal(); fatal != "" {
+		return fatalError(fatal)
+	}
+	return i.err
+}
+
+// fatalError is an error reported by the core that stops it from starting
+// with the current config.
+type fatalError string
+
+func (e fatalError) Error() string {
+	return string(e)
+}
+
+// stop terminates the core gracefully, and kills it if it does not exit in
+// VC_CORE_STOP_TIMEOUT.
+func (i *instance) stop() {
+	if err := i.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		slog.Warn("killing core with signal TERM fail", slog.ErrorKey, err)
+	}
+	select {
+	case <-i.exited:
+	case <-time.After(coreStopTimeout):
+		slog.Warn(fmt.Sprintf("core %d did not stop in %s, kill it", i.cmd.Process.Pid, coreStopTimeout))
+		_ = i.cmd.Process.Kill()
+		<-i.exited
+	}
+}
+
+type CoreStatus struct {
+	State      string     `json:"state"`
+	Ready      bool       `json:"ready"`
+	Pid        int        `json:"pid,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	Restarts   int        `json:"restarts"`
+	Crashes    int        `json:"consecutiveCrashes"`
+	LastExit   string     `json:"lastExit,omitempty"`
+	LastExitAt *time.Time `json:"lastExitAt,omitempty"`
+	NextStart  *time.Time `json:"nextStart,omitempty"`
+}
+
+type coreSupervisor struct {
+	mux     sync.Mutex
+	status  CoreStatus
+	readyCh chan struct{}
+}
+
+var supervisor = &coreSupervisor{
+	status:  CoreStatus{State: CoreStarting},
+	readyCh: make(chan struct{}),
+}
+
+func (s *coreSupervisor) setReady(ready bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if ready == s.status.Ready {
+		return
+	}
+	if ready {
+		close(s.readyCh)
+	} else {
+		s.readyCh = make(chan struct{})
+	}
+	s.status.Ready = ready
+}
+
+// markReady opens the readiness gate of the core with pid, and publishes
+// whether it got ready in time.
+func (s *coreSupervisor) markReady(pid int, err error) {
+	data := map[string]any{"pid": pid}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	events.publish(EventCoreReady, data)
+	s.setReady(true)
+}
+
+// waitReady blocks until the core is ready to serve, or timeout.
+func (s *coreSupervisor) waitReady(ctx context.Context, timeout time.Duration) bool {
+	s.mux.Lock()
+	ch := s.readyCh
+	s.mux.Unlock()
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (s *coreSupervisor) started(pid int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	if s.status.StartedAt != nil {
+		s.status.Restarts++
+	}
+	s.status.State, s.status.Pid, s.status.StartedAt, s.status.NextStart = CoreRunning, pid, &now, nil
+	events.publish(EventCoreStarted, map[string]any{"pid": pid})
+	if s.status.Restarts > 0 {
+		events.publish(EventCoreRestarted, map[string]any{"pid": pid, "restarts": s.status.Restarts})
+	}
+}
+
+func (s *coreSupervisor) exited(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	s.status.Pid, s.status.LastExitAt = 0, &now
+	s.status.LastExit = "exited"
+	if err != nil {
+		s.status.LastExit = err.Error()
+	}
+	events.publish(EventCoreExited, map[string]any{"reason": s.status.LastExit})
+}
+
+func (s *coreSupervisor) set(state string, crashes int, next *time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.status.State, s.status.Crashes, s.status.NextStart = state, crashes, next
+}
+
+func (s *coreSupervisor) Status() CoreStatus {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.status
+}
+
+func backoff(crashes int) time.Duration {
+	d := coreBackoffMin
+	for n := 1; n < crashes && d < coreBackoffMax; n++ {
+		d *= 2
+	}
+	if d > coreBackoffMax {
+		d = coreBackoffMax
+	}
+	return d
+}
+
+// runCoreLoop keeps the core running, restarting it on request, and backing
+// off exponentially when it keeps crashing.
+func runCoreLoop(ctx context.Context, filename string, restart chan struct{}) {
+	crashes := 0
+	for {
+		slog.Info("run core...")
+		coreStarted(filename)
+		i, err := launch(filename, 0)
+		requested := false
+		if err != nil {
+			slog.Error("core running failed", err)
+			supervisor.exited(err)
+		} else {
+			supervisor.started(i.cmd.Process.Pid)
+			go awaitReady(ctx, filename, i)
+			select {
+			case <-ctx.Done():
+				slog.Info("stop core...")
+				supervisor.setReady(false)
+				i.stop()
+				supervisor.exited(nil)
+				supervisor.set(CoreStopped, 0, nil)
+				return
+			case <-restart:
+				slog.Info("stop core...")
+				supervisor.setReady(false)
+				i.stop()
+				requested = true
+			case <-i.exited:
+				supervisor.setReady(false)
+			}
+			supervisor.exited(i.exitErr())
+		}
+		if requested {
+			crashes = 0
+			continue
+		}
+		if i != nil && time.Since(i.startedAt) > coreStableAfter {
+			crashes = 0
+		}
+		crashes++
+		if i != nil {
+			err = i.exitErr()
+		}
+		var fatal fatalError
+		if errors.As(err, &fatal) || coreMaxRestarts > 0 && crashes > coreMaxRestarts {
+			if fatal != "" {
+				slog.Error("core cannot start with the config, give up until restart is requested", err)
+			} else {
+				slog.Error(fmt.Sprintf("core crashed %d times in a row, give up until restart is requested", crashes), err)
+			}
+			supervisor.set(CoreFailed, crashes, nil)
+			select {
+			case <-ctx.Done():
+				supervisor.set(CoreStopped, crashes, nil)
+				return
+			case <-restart:
+				crashes = 0
+				continue
+			}
+		}
+		state, delay := CoreBackoff, backoff(crashes)
+		if crashes >= coreCrashLoop {
+			state = CoreCrashLoop
+			slog.Error(fmt.Sprintf("core is crash looping, %d crashes in a row", crashes), err)
+		}
+		next := time.Now().Add(delay)
+		supervisor.set(state, crashes, &next)
+		slog.Info(fmt.Sprintf("restart core in %s", delay))
+		select {
+		case <-ctx.Done():
+			supervisor.set(CoreStopped, crashes, nil)
+			return
+		case <-restart:
+			crashes = 0
+		case <-time.After(delay):
+		}
+	}
+}
+
+func awaitReady(ctx context.Context, filename string, i *instance) {
+	cfg, err := loadConfigFile(filename)
+	if err == nil {
+		err = waitInbounds(ctx, cfg, i.exited, coreReady)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	select {
+	case <-i.exited:
+		return
+	default:
+	}
+	if err != nil {
+		// a closed gate would fail every check for as long as the core runs,
+		// the checks find out which endpoints the core does not serve
+		slog.Error("core is not ready, let the checks run anyway", err)
+	} else {
+		slog.Info("core is ready")
+	}
+	supervisor.markReady(i.cmd.Process.Pid, err)
+}
+
+// waitInbounds polls the inbounds of cfg until all of them accept
+// connections, the core exits, or timeout.
+func waitInbounds(ctx context.Context, cfg *vc.Config, exited <-chan struct{}, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, inbound := range cfg.Inbounds {
+		port, ok := inboundPort(inbound)
+		if !ok || !servesTcp(inbound) {
+			continue
+		}
+		host := inbound.Listen
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		for {
+			err := selfCheck(addr, inbound.Protocol)
+			if err == nil {
+				break
+			}
+			select {
+			case <-exited:
+				return errors.Errorf("core exited before getting ready")
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(readyInterval):
+			}
+			if time.Now().After(deadline) {
+				return errors.Wrapf(err, "core is not ready on %s after %s", addr, timeout)
+			}
+		}
+	}
+	return nil
+}
+
+// servesTcp reports whether an inbound accepts tcp connections, which udp
+// only inbounds, like a dokodemo-door for dns, do not.
+func servesTcp(inbound *vc.Inbound) bool {
+	if inbound.Settings == nil || inbound.Settings.Network == "" {
+		return true
+	}
+	for _, network := range strings.Split(inbound.Settings.Network, ",") {
+		if strings.TrimSpace(network) == "tcp" {
+			return true
+		}
+	}
+	return false
+}
+
+// selfCheck connects to an inbound and, for socks inbounds, completes the
+// method negotiation to make sure the core is actually serving it.
+func selfCheck(addr string, protocol string) error {
+	conn, err := net.DialTimeout("tcp", addr, readyInterval)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if protocol != "socks" {
+		return nil
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return errors.Errorf("unexpected socks reply %v", reply)
+	}
+	return nil
+}
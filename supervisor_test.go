@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"vc/vc"
+)
+
+func TestWaitInbounds(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	port := l.Addr().(*net.TCPAddr).Port
+	exited := make(chan struct{})
+	// nothing listens for tcp on the dns inbound, which only serves udp
+	cfg := &vc.Config{Inbounds: []*vc.Inbound{
+		{Tag: "dns", Listen: "127.0.0.1", Port: 1, Protocol: "dokodemo-door", Settings: &vc.InboundCommonSettings{Network: "udp"}},
+		{Tag: "http", Listen: "127.0.0.1", Port: port, Protocol: "http", Settings: &vc.InboundCommonSettings{Network: "tcp,udp"}},
+	}}
+	if err := waitInbounds(context.Background(), cfg, exited, time.Second); err != nil {
+		t.Errorf("waitInbounds() = %v", err)
+	}
+	cfg.Inbounds[0].Settings.Network = "tcp"
+	if err := waitInbounds(context.Background(), cfg, exited, time.Second); err == nil {
+		t.Errorf("waitInbounds() with a closed tcp port succeeded")
+	}
+}
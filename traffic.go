@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vc/core"
+	"vc/vc"
+)
+
+var (
+	trafficStats  = false
+	trafficPeriod = time.Second * 30
+)
+
+func init() {
+	if s, ok := os.LookupEnv("VC_TRAFFIC_STATS"); ok && (s == "true" || s == "on") {
+		slog.Info("traffic statistics enabled")
+		trafficStats = true
+	}
+	if s := os.Getenv("VC_TRAFFIC_STATS_PERIOD"); s != "" {
+		if sec, err := strconv.ParseInt(s, 10, 64); err != nil || sec <= 0 {
+			slog.Warn(fmt.Sprintf("invalid environment value: VC_TRAFFIC_STATS_PERIOD=%s", s))
+		} else {
+			trafficPeriod = time.Second * time.Duration(sec)
+		}
+	}
+}
+
+// enableStats turns on the traffic counters of every inbound, outbound and
+// user of level 0.
+func enableStats(cfg *vc.Config) {
+	cfg.Stats = &vc.Stats{}
+	if cfg.Policy == nil {
+		cfg.Policy = &vc.Policy{}
+	}
+	if cfg.Policy.System == nil {
+		cfg.Policy.System = &vc.SystemPolicy{}
+	}
+	system := cfg.Policy.System
+	system.StatsInboundUplink, system.StatsInboundDownlink = true, true
+	system.StatsOutboundUplink, system.StatsOutboundDownlink = true, true
+	if cfg.Policy.Levels == nil {
+		cfg.Policy.Levels = map[string]*vc.LevelPolicy{}
+	}
+	if cfg.Policy.Levels["0"] == nil {
+		cfg.Policy.Levels["0"] = &vc.LevelPolicy{}
+	}
+	cfg.Policy.Levels["0"].StatsUserUplink, cfg.Policy.Levels["0"].StatsUserDownlink = true, true
+}
+
+type Traffic struct {
+	Uplink   int64 `json:"uplink"`
+	Downlink int64 `json:"downlink"`
+}
+
+// TrafficStats are the traffic totals since Since, accumulated across core
+// restarts.
+type TrafficStats struct {
+	Since     time.Time           `json:"since"`
+	UpdatedAt *time.Time          `json:"updatedAt,omitempty"`
+	Endpoints map[string]*Traffic `json:"endpoints"`
+	Inbounds  map[string]*Traffic `json:"inbounds"`
+	Users     map[string]*Traffic `json:"users"`
+}
+
+var (
+	trafficMux = &sync.Mutex{}
+	traffic    = newTrafficStats()
+)
+
+func newTrafficStats() *TrafficStats {
+	return &TrafficStats{
+		Since:     time.Now(),
+		Endpoints: map[string]*Traffic{},
+		Inbounds:  map[string]*Traffic{},
+		Users:     map[string]*Traffic{},
+	}
+}
+
+func queryStats(ctx context.Context) ([]core.Stat, error) {
+	service := coreDriver.StatsService()
+	if service == "" {
+		return nil, errors.Errorf("traffic stats are not supported by %s", coreDriver.Name())
+	}
+	return core.QueryStats(ctx, fmt.Sprintf("127.0.0.1:%d", coreApiPort), service, true)
+}
+
+// addTraffic adds counters reset by the query to the totals. The traffic of
+// checks, through the test inbounds and outbounds, and of the api is left out.
+// Traffic of the default outbound copy goes to its endpoint.
+func addTraffic(counters []core.Stat) bool {
+	trafficMux.Lock()
+	defer trafficMux.Unlock()
+	added := false
+	for _, c := range counters {
+		value := c.Value
+		if value == 0 {
+			continue
+		}
+		parts := strings.Split(c.Name, ">>>")
+		if len(parts) != 4 || parts[2] != "traffic" {
+			continue
+		}
+		var totals map[string]*Traffic
+		tag := parts[1]
+		switch parts[0] {
+		case "outbound":
+			if tag == coreApiTag || strings.HasPrefix(tag, testOutPrefix) {
+				continue
+			}
+			totals, tag = traffic.Endpoints, strings.TrimPrefix(tag, defaultOutPrefix)
+		case "inbound":
+			if tag == coreApiTag || strings.HasPrefix(tag, "test-in-") {
+				continue
+			}
+			totals = traffic.Inbounds
+		case "user":
+			totals = traffic.Users
+		default:
+			continue
+		}
+		t := totals[tag]
+		if t == nil {
+			t = &Traffic{}
+			totals[tag] = t
+		}
+		switch parts[3] {
+		case "uplink":
+			t.Uplink += value
+		case "downlink":
+			t.Downlink += value
+		default:
+			continue
+		}
+		added = true
+	}
+	if added {
+		now := time.Now()
+		traffic.UpdatedAt = &now
+	}
+	return added
+}
+
+// trafficTotals returns a copy of the totals.
+func trafficTotals() TrafficStats {
+	trafficMux.Lock()
+	defer trafficMux.Unlock()
+	c := *traffic
+	c.Endpoints, c.Inbounds, c.Users = copyTraffic(traffic.Endpoints), copyTraffic(traffic.Inbounds), copyTraffic(traffic.Users)
+	return c
+}
+
+func copyTraffic(m map[string]*Traffic) map[string]*Traffic {
+	c := make(map[string]*Traffic, len(m))
+	for k, v := range m {
+		t := *v
+		c[k] = &t
+	}
+	return c
+}
+
+func trafficLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("stop traffic stats loop")
+			return
+		case <-time.After(trafficPeriod):
+		}
+		if !supervisor.Status().Ready {
+			continue
+		}
+		counters, err := queryStats(ctx)
+		if err != nil {
+			slog.Warn("querying traffic stats failed", slog.ErrorKey, err)
+			continue
+		}
+		if addTraffic(counters) {
+			if err := saveTraffic(trafficFile()); err != nil {
+				slog.Warn("saving traffic stats failed", slog.ErrorKey, err)
+			}
+		}
+	}
+}
+
+func trafficFile() string {
+	return filepath.Join(stateDir, "traffic.json")
+}
+
+func loadTraffic(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "reading traffic file failed")
+	}
+	saved := newTrafficStats()
+	if err := json.Unmarshal(data, saved); err != nil {
+		return errors.Wrap(err, "decoding traffic file failed")
+	}
+	for _, m := range []*map[string]*Traffic{&saved.Endpoints, &saved.Inbounds, &saved.Users} {
+		if *m == nil {
+			*m = map[string]*Traffic{}
+		}
+	}
+	trafficMux.Lock()
+	defer trafficMux.Unlock()
+	traffic = saved
+	return nil
+}
+
+func saveTraffic(filename string) error {
+	data, err := json.Marshal(trafficTotals())
+	if err != nil {
+		return errors.Wrap(err, "encoding traffic failed")
+	}
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "writing traffic file failed")
+	}
+	return errors.Wrap(os.Rename(tmp, filename), "replacing traffic file failed")
+}
+
+func handleTraffic(w http.ResponseWriter, _ *http.Request) {
+	if !trafficStats {
+		http.Error(w, "traffic statistics is not enabled", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(trafficTotals())
+}
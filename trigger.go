@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"vc/sub/check"
+)
+
+type SubResult struct {
+	Changed   bool   `json:"changed"`
+	Parsed    int    `json:"parsed"`
+	Rejected  int    `json:"rejected"`
+	Endpoints int    `json:"endpoints"`
+	Restarted bool   `json:"restarted"`
+	Error     string `json:"error,omitempty"`
+}
+
+type CheckResult struct {
+	Changed   bool           `json:"changed"`
+	Checked   int            `json:"checked"`
+	Healthy   int            `json:"healthy"`
+	AllDown   bool           `json:"allDown"`
+	Restarted bool           `json:"restarted"`
+	Error     string         `json:"error,omitempty"`
+	Results   []check.Report `json:"results,omitempty"`
+}
+
+// run is a pending or running job of a loop, shared by every trigger that
+// arrives before it starts.
+type run struct {
+	reason string
+	done   chan struct{}
+	result any
+}
+
+func (r *run) finish(result any) {
+	r.result = result
+	close(r.done)
+}
+
+// trigger coalesces requests to run the job of a loop, so that concurrent
+// requests wait for the same run instead of queueing up.
+type trigger struct {
+	mux     sync.Mutex
+	pending *run
+	wake    chan struct{}
+}
+
+func newTrigger() *trigger {
+	return &trigger{wake: make(chan struct{}, 1)}
+}
+
+// fire requests a run, joining the pending one if any.
+func (t *trigger) fire(reason string) *run {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.pending == nil {
+		t.pending = &run{reason: reason, done: make(chan struct{})}
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+	return t.pending
+}
+
+// take starts the pending run, later requests go to a new one.
+func (t *trigger) take() *run {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	r := t.pending
+	t.pending = nil
+	return r
+}
+
+// handleTrigger responds 202 at once, or with the result of the run when
+// the request asks to wait for it.
+func handleTrigger(w http.ResponseWriter, r *http.Request, run *run) {
+	if r.URL.Query().Get("wait") != "true" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	select {
+	case <-run.done:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(run.result)
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrigger(t *testing.T) {
+	tr := newTrigger()
+	a, b := tr.fire("api"), tr.fire("schedule")
+	if a != b {
+		t.Fatalf("a trigger before the run starts got a run of its own")
+	}
+	if a.reason != "api" {
+		t.Errorf("reason = %s, want api", a.reason)
+	}
+	<-tr.wake
+	select {
+	case <-tr.wake:
+		t.Errorf("the loop is woken up twice for one run")
+	default:
+	}
+	if r := tr.take(); r != a {
+		t.Fatalf("take() = %p, want the pending run %p", r, a)
+	}
+	// a trigger while running waits for the next run
+	c := tr.fire("api")
+	if c == a {
+		t.Errorf("a trigger while running joined the running run")
+	}
+	a.finish(&SubResult{Changed: true})
+	<-a.done
+	if r := tr.take(); r != c {
+		t.Errorf("take() = %p, want the pending run %p", r, c)
+	}
+	if r := tr.take(); r != nil {
+		t.Errorf("take() without a trigger = %p, want nil", r)
+	}
+
+	w := httptest.NewRecorder()
+	handleTrigger(w, httptest.NewRequest(http.MethodPost, "/api/sub", nil), c)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+	w = httptest.NewRecorder()
+	handleTrigger(w, httptest.NewRequest(http.MethodPost, "/api/sub?wait=true", nil), a)
+	if body := w.Body.String(); !strings.Contains(body, `"changed":true`) {
+		t.Errorf("body = %s, want the result of the run", body)
+	}
+}
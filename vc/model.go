@@ -7,12 +7,46 @@ import (
 
 type Config struct {
 	Log       *Log        `json:"log,omitempty"`
+	Api       *Api        `json:"api,omitempty"`
+	Stats     *Stats      `json:"stats,omitempty"`
+	Policy    *Policy     `json:"policy,omitempty"`
 	Dns       *Dns        `json:"dns,omitempty"`
 	Routing   *Routing    `json:"routing,omitempty"`
 	Inbounds  []*Inbound  `json:"inbounds,omitempty"`
 	Outbounds []*Outbound `json:"outbounds,omitempty"`
 }
 
+type Api struct {
+	Tag      string   `json:"tag,omitempty"`
+	Services []string `json:"services,omitempty"`
+}
+
+// Stats enables the traffic counters of the core, it has no settings.
+type Stats struct {
+}
+
+type Policy struct {
+	Levels map[string]*LevelPolicy `json:"levels,omitempty"`
+	System *SystemPolicy           `json:"system,omitempty"`
+}
+
+type LevelPolicy struct {
+	Handshake         json.Number `json:"handshake,omitempty"`
+	ConnIdle          json.Number `json:"connIdle,omitempty"`
+	UplinkOnly        json.Number `json:"uplinkOnly,omitempty"`
+	DownlinkOnly      json.Number `json:"downlinkOnly,omitempty"`
+	StatsUserUplink   bool        `json:"statsUserUplink,omitempty"`
+	StatsUserDownlink bool        `json:"statsUserDownlink,omitempty"`
+	BufferSize        json.Number `json:"bufferSize,omitempty"`
+}
+
+type SystemPolicy struct {
+	StatsInboundUplink    bool `json:"statsInboundUplink,omitempty"`
+	StatsInboundDownlink  bool `json:"statsInboundDownlink,omitempty"`
+	StatsOutboundUplink   bool `json:"statsOutboundUplink,omitempty"`
+	StatsOutboundDownlink bool `json:"statsOutboundDownlink,omitempty"`
+}
+
 type Log struct {
 	Access   string `json:"access,omitempty"`
 	Error    string `json:"error,omitempty"`
@@ -118,6 +152,8 @@ type InboundCommonSettings struct {
 	Udp              bool        `json:"udp,omitempty"`
 	IP               string      `json:"ip,omitempty"`
 	UserLevel        json.Number `json:"userLevel,omitempty"`
+	Address          string      `json:"address,omitempty"`
+	Network          string      `json:"network,omitempty"`
 }
 
 type Account struct {
@@ -163,10 +199,12 @@ type VNext struct {
 }
 
 type User struct {
-	Id       string      `json:"id,omitempty"`
-	AlterId  json.Number `json:"alterId"`
-	Security string      `json:"security,omitempty"`
-	Level    int64       `json:"level"`
+	Id         string      `json:"id,omitempty"`
+	AlterId    json.Number `json:"alterId"`
+	Security   string      `json:"security,omitempty"`
+	Encryption string      `json:"encryption,omitempty"`
+	Flow       string      `json:"flow,omitempty"`
+	Level      int64       `json:"level"`
 }
 
 type StreamSettings struct {
@@ -178,6 +216,9 @@ type StreamSettings struct {
 	WsSettings   *WsSettings   `json:"wsSettings,omitempty"`
 	HttpSettings *HttpSettings `json:"httpSettings,omitempty"`
 	QUICSettings *QUICSettings `json:"quicSettings,omitempty"`
+	GrpcSettings *GrpcSettings `json:"grpcSettings,omitempty"`
+	// RealitySettings is only supported by Xray.
+	RealitySettings *RealitySettings `json:"realitySettings,omitempty"`
 }
 
 type TlsSettings struct {
@@ -188,6 +229,16 @@ type TlsSettings struct {
 	Certificates                     []*Certificate `json:"certificates,omitempty"`
 	VerifyClientCertificate          bool           `json:"verifyClientCertificate,omitempty"`
 	PinnedPeerCertificateChainSha256 string         `json:"pinnedPeerCertificateChainSha256,omitempty"`
+	Fingerprint                      string         `json:"fingerprint,omitempty"`
+}
+
+type RealitySettings struct {
+	Show        bool   `json:"show,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	PublicKey   string `json:"publicKey,omitempty"`
+	ShortId     string `json:"shortId,omitempty"`
+	SpiderX     string `json:"spiderX,omitempty"`
 }
 
 type Certificate struct {
@@ -257,6 +308,11 @@ type QUICSettings struct {
 	Header   *Headers `json:"header,omitempty"`
 }
 
+type GrpcSettings struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	MultiMode   bool   `json:"multiMode,omitempty"`
+}
+
 type ProxySettings struct {
 	Tag            string `json:"tag,omitempty"`
 	TransportLayer bool   `json:"transportLayer,omitempty"`